@@ -0,0 +1,241 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// maxMessage is the limit of TG message [ 4096 ] with some room for the closing code fence and wide symbols
+const maxMessage = 4000
+
+// placeholder is shown right away, before the pod produces anything
+const placeholder = "…"
+
+// Answer streams the output into TG messages. When the output grows beyond TG limits,
+// it rolls over into continuation messages: earlier parts are frozen and only the tail message is edited
+type Answer struct {
+	to     tele.Recipient
+	markup *tele.ReplyMarkup // shown with the tail while the output is streamed
+
+	frozen      int           // how many parts were frozen in earlier messages
+	tail        tele.Editable // the message with the last part, nil when not sent yet
+	shown       string        // what the user sees within the tail right now
+	placeholder bool          // the tail shows the placeholder only
+}
+
+func newAnswer(to tele.Recipient, markup *tele.ReplyMarkup) *Answer {
+	return &Answer{to: to, markup: markup}
+}
+
+// Sent tells whether any output was shown to the user
+func (answer *Answer) Sent() bool {
+	return answer.frozen > 0 || answer.tail != nil && !answer.placeholder
+}
+
+// Placeholder sends the message which is edited in place with the output later
+func (answer *Answer) Placeholder() error {
+	msg, err := sender.Send(answer.to, placeholder)
+	if err != nil {
+		return err
+	}
+	answer.tail = msg
+	answer.placeholder = true
+	return nil
+}
+
+// Say shows the text instead of the placeholder, or sends it as the new message otherwise
+func (answer *Answer) Say(text string) error {
+	if answer.placeholder {
+		answer.placeholder = false
+		_, err := sender.Edit(answer.tail, text)
+		return err
+	}
+	_, err := sender.Send(answer.to, text)
+	return err
+}
+
+// Update shows the output produced so far, sending new messages when needed and queueing the edit of the tail otherwise
+func (answer *Answer) Update(output string) error {
+	parts, err := answer.freeze(output)
+	if err != nil {
+		return err
+	}
+
+	tail := parts[len(parts)-1]
+	if tail == "" || tail == answer.shown {
+		return nil
+	}
+
+	if answer.tail == nil {
+		text, opts := formatted(tail, answer.markup)
+		msg, err := sender.Send(answer.to, text, opts...)
+		if err != nil {
+			return err
+		}
+		answer.tail = msg
+	} else {
+		text, opts := formatted(tail, answer.markup)
+		sender.Update(answer.tail, text, opts...)
+	}
+
+	answer.shown = tail
+	answer.placeholder = false
+	return nil
+}
+
+// Finish shows the final output and drops the markup from the tail message
+func (answer *Answer) Finish(output string) error {
+	parts, err := answer.freeze(output)
+	if err != nil {
+		return err
+	}
+
+	tail := parts[len(parts)-1]
+	text, opts := formatted(tail)
+	switch {
+	case answer.tail != nil && tail != "":
+		// NB! The latest text is sent anyway, as the previous edit might be still queued
+		_, err = sender.Edit(answer.tail, text, opts...)
+	case answer.tail != nil:
+		_, err = sender.Edit(answer.tail, (*tele.ReplyMarkup)(nil))
+	case tail != "":
+		answer.tail, err = sender.Send(answer.to, text, opts...)
+	}
+
+	answer.shown = tail
+	answer.placeholder = false
+	return err
+}
+
+// freeze finalizes all parts of the output except the last one, which are not frozen yet, and returns all the parts
+func (answer *Answer) freeze(output string) ([]string, error) {
+	parts := render(output)
+
+	for answer.frozen < len(parts)-1 {
+		text, opts := formatted(parts[answer.frozen])
+		var err error
+		if answer.tail != nil {
+			_, err = sender.Edit(answer.tail, text, opts...)
+		} else {
+			_, err = sender.Send(answer.to, text, opts...)
+		}
+		if err != nil {
+			log.Errorw("[ ERR ] Problem freezing the part of the answer", "part", answer.frozen, "error", err.Error())
+			return nil, err
+		}
+		answer.frozen++
+		answer.tail = nil
+		answer.shown = ""
+		answer.placeholder = false
+	}
+
+	return parts, nil
+}
+
+// restore continues the answer which was partially shown before restart, or replaces the placeholder sent before it
+func (answer *Answer) restore(frozen int, tail tele.Editable, output string, placeholder bool) {
+	answer.frozen = frozen
+	answer.tail = tail
+	answer.placeholder = tail != nil && placeholder
+	if tail != nil && !placeholder {
+		parts := render(output)
+		answer.shown = parts[len(parts)-1]
+	}
+}
+
+// render splits the output into parts fitting into TG messages and formats each of them.
+// Formatting hardly makes the text longer than the markup, but if it does, the part is shown as the plain text,
+// which fits for sure, instead of being rejected by TG
+func render(output string) []string {
+	parts := splitMessage(output, maxMessage)
+	for i, part := range parts {
+		parts[i] = formatHTML(part)
+		if plain, _ := htmlEntities(parts[i]); utf8.RuneCountInString(plain) > maxMessage {
+			log.Errorw("[ ERR ] Formatted part is too long, fallback to the plain text", "part", i, "size", utf8.RuneCountInString(plain))
+			parts[i] = escaper.Replace(part)
+		}
+	}
+	return parts
+}
+
+// splitMessage cuts the text into parts which fit into TG message. Parts are cut at paragraph or
+// code block boundaries if possible, the code block cut in the middle is closed and reopened with the next part.
+// NB! Each cut depends only on the text before it, so earlier parts stay the same while the text grows
+func splitMessage(text string, limit int) []string {
+	var parts []string
+	for utf8.RuneCountInString(text) > limit {
+		cut, fence := cutMessage(text, limit-4)
+		part := strings.TrimRight(text[:cut], "\n")
+		text = strings.TrimLeft(text[cut:], "\n")
+		if fence != "" {
+			part += "\n```"
+			text = fence + "\n" + text
+		}
+		parts = append(parts, part)
+	}
+	return append(parts, text)
+}
+
+// cutMessage finds the best place to cut the text within the limit, returning the opening fence
+// of the code block if the cut is inside of it
+func cutMessage(text string, limit int) (cut int, fence string) {
+
+	// -- the window fitting the limit
+	end := len(text)
+	for i := range text {
+		if limit == 0 {
+			end = i
+			break
+		}
+		limit--
+	}
+
+	// -- paragraphs and code blocks are the best places to cut, but not too close to the start
+	clean, line := -1, -1
+	lineFence, open := "", ""
+	fenceStart, fenceEnd := -1, -1 // the line opening the code block
+	for pos := 0; pos < end; {
+		n := strings.IndexByte(text[pos:end], '\n')
+		if n < 0 {
+			break
+		}
+		start := pos
+		trimmed := strings.TrimSpace(text[pos : pos+n])
+		pos += n + 1
+
+		switch {
+		case strings.HasPrefix(trimmed, "```") && open != "":
+			open = ""
+			clean = pos
+		case strings.HasPrefix(trimmed, "```"):
+			open = trimmed
+			fenceStart, fenceEnd = start, pos
+		case trimmed == "" && open == "":
+			clean = pos
+		}
+		line, lineFence = pos, open
+	}
+
+	switch {
+	case clean > 0 && clean >= end/2:
+		return clean, ""
+
+	// -- NB! The cut right after the opening fence leaves the part without code, while the rest is reopened
+	// with the same fence and never gets shorter. So the text before the block goes alone, or the long code line
+	// is cut at the limit
+	case line > 0 && lineFence != "" && line == fenceEnd:
+		switch {
+		case strings.TrimSpace(text[:fenceStart]) != "":
+			return fenceStart, ""
+		case end > fenceEnd:
+			return end, lineFence
+		}
+		return end, "" // the fence line alone fills the whole part
+
+	case line > 0:
+		return line, lineFence
+	}
+	return end, open
+}
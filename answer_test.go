@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		parts int
+	}{
+		{"short", "hello", 100, 1},
+		{"exact", strings.Repeat("x", 100), 100, 1},
+		{"paragraphs", strings.Repeat("word word word\n\n", 20), 100, 4},
+		{"long line", strings.Repeat("x", 250), 100, 3},
+		{"long line after text", "intro\n" + strings.Repeat("x", 250), 100, 4},
+		{"long wide line", strings.Repeat("я", 250), 100, 3},
+		{"code block", "```go\n" + strings.Repeat("fmt.Println()\n", 20) + "```", 100, 4},
+		{"long code line", "```go\n" + strings.Repeat("x", 250), 100, 3},
+		{"long code line after text", "intro\n```go\n" + strings.Repeat("x", 250), 100, 4},
+		{"long closed code line", "```\n" + strings.Repeat("y", 230) + "\n```", 100, 3},
+		{"long code line after blank lines", "\n\n```go\n" + strings.Repeat("x", 250), 100, 3},
+		{"long code line after code", "```go\nshort\n" + strings.Repeat("x", 250), 100, 4},
+		{"long fence line exactly", "```" + strings.Repeat("x", 92) + "\n" + strings.Repeat("y", 50), 100, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parts := splitWithin(t, test.text, test.limit)
+			if len(parts) != test.parts {
+				t.Errorf("got %d parts, want %d: %q", len(parts), test.parts, parts)
+			}
+			for i, part := range parts {
+				if size := utf8.RuneCountInString(part); size > test.limit {
+					t.Errorf("part %d is %d runes, limit %d", i, size, test.limit)
+				}
+				if part == "" {
+					t.Errorf("part %d is empty", i)
+				}
+			}
+			if got, want := content(strings.Join(parts, "\n")), content(test.text); got != want {
+				t.Errorf("content is changed:\n got %q\nwant %q", got, want)
+			}
+		})
+	}
+}
+
+// Earlier parts should stay the same while the text grows, as they might be already frozen
+func TestSplitMessageStable(t *testing.T) {
+	texts := []string{
+		strings.Repeat("word word word\n\n", 40),
+		"intro\n```go\n" + strings.Repeat("x", 500),
+		"```go\n" + strings.Repeat("fmt.Println()\n", 40) + "```\n\nThe end",
+	}
+
+	for _, text := range texts {
+		final := splitWithin(t, text, 100)
+		for size := 1; size < len(text); size++ {
+			parts := splitWithin(t, text[:size], 100)
+			for i := 0; i < len(parts)-1; i++ {
+				if parts[i] != final[i] {
+					t.Fatalf("part %d of %q is changed:\n got %q\nwant %q", i, text[:size], parts[i], final[i])
+				}
+			}
+		}
+	}
+}
+
+// splitWithin fails the test instead of hanging when the split never ends
+func splitWithin(t *testing.T, text string, limit int) []string {
+	t.Helper()
+	done := make(chan []string, 1)
+	go func() { done <- splitMessage(text, limit) }()
+	select {
+	case parts := <-done:
+		return parts
+	case <-time.After(5 * time.Second):
+		t.Fatalf("split of %q never ends", text)
+	}
+	return nil
+}
+
+// content drops code fences and line breaks, which are added or removed by the split
+func content(text string) string {
+	var out []string
+	for _, line := range strings.Split(text, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "```") {
+			out = append(out, line)
+		}
+	}
+	return strings.Join(out, "")
+}
+
+// Formatted parts should fit TG limits too, even when the formatting makes them wider than the markup
+func TestRenderWithinLimit(t *testing.T) {
+	wide := "| Name | Note |\n|---|---|\n| " + strings.Repeat("x", 300) + " | first |\n"
+	for i := 0; i < 120; i++ {
+		wide += "| row | short |\n"
+	}
+
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"table wider than the limit", wide},
+		{"many rules", strings.Repeat("text\n---\n", 500)},
+		{"code blocks", strings.Repeat("```go\n"+strings.Repeat("fmt.Println()\n", 100)+"```\n", 10)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i, part := range render(test.text) {
+				plain, _ := htmlEntities(part)
+				if size := utf8.RuneCountInString(plain); size > maxMessage {
+					t.Errorf("part %d is %d runes, limit %d", i, size, maxMessage)
+				}
+			}
+		})
+	}
+}
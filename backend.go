@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrBadRequest  = errors.New("could not build request for the pod")
+	ErrJobNotFound = errors.New("requested job was not found on the pod")
+)
+
+// Backend hides the protocol spoken by the GPU pod, so inference servers
+// with different APIs might live within the same zoo
+type Backend interface {
+	// Submit sends the new job to the pod
+	Submit(ctx context.Context, job *Job) error
+	// Stream blocks until the job is finished, calling update with all the output produced so far.
+	// Backends without streaming support are free to poll the pod under the hood
+	Stream(ctx context.Context, job *Job, update func(output string) error) error
+	// Cancel asks the pod to abort the job and free the GPU slot
+	Cancel(ctx context.Context, job *Job) error
+	// Ping checks the pod is alive and able to serve requests
+	Ping(ctx context.Context) error
+}
+
+// updateInterval limits how often streaming backends report the output
+const updateInterval = 3000 * time.Millisecond
+
+// newBackend returns the protocol implementation for the pod with given address
+func newBackend(server string) Backend {
+	mu.Lock()
+	pod, found := pods[server]
+	mu.Unlock()
+
+	if !found {
+		return newJobsBackend(server)
+	}
+	return pod.backend
+}
+
+// -- Helpers
+
+// ping requests the URL and treats any answer except server errors as the sign of alive pod
+func ping(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBadRequest, err.Error())
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	res.Body.Close()
+
+	if res.StatusCode >= 500 {
+		return fmt.Errorf("wrong status code: %d", res.StatusCode)
+	}
+	return nil
+}
+
+// sleep waits for the given duration, but breaks early if the context is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// JobsBackend speaks the native telezoo protocol:
+// POST /jobs to start the job, then polling GET /jobs/{id} until it's finished.
+// Pods might answer POST /jobs with SSE or chunked JSON stream of JobEvent instead,
+// then the output is consumed as it goes without any polling.
+// Pods which can't stream might advertise long polling with X-Long-Poll header [ max wait in seconds ],
+// then GET /jobs/{id}?wait=N is held by the pod until the output changes.
+// When callbacks are enabled, pods might answer with X-Callback: accepted header
+// and push the progress to the job callback URL instead, authorized with the job callback token
+type JobsBackend struct {
+	Server string // Pod address like http://127.0.0.1:8080
+
+	// allow more time for important requests and less for those which might be ignored
+	// NB! slowHTTP limits only the time to get headers, so streaming answers are not broken
+	slowHTTP http.Client
+	fastHTTP http.Client
+	waitHTTP http.Client // NB! Deadlines for long polling are set per request
+
+	wait atomic.Int64 // Long polling wait in seconds advertised by the pod, zero when not supported
+
+	mu      sync.Mutex
+	streams map[string]*podStream // Streaming jobs in flight by ID
+}
+
+// JobEvent is streamed by pods: either the whole output so far, or just the next token
+type JobEvent struct {
+	Output string `json:"output,omitempty"`
+	Token  string `json:"token,omitempty"`
+	Status string `json:"status,omitempty"`
+}
+
+const (
+	maxLongPoll  = 30                     // Seconds to hold long polling requests at most
+	longPollPace = 500 * time.Millisecond // Minimal time between long polling requests
+	callbackIdle = 60 * time.Second       // Check the job by ourselves when the pod is silent for too long
+)
+
+var errCallbackIdle = errors.New("no callbacks from the pod for too long")
+
+func newJobsBackend(server string) *JobsBackend {
+	return &JobsBackend{
+		Server: server,
+		slowHTTP: http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+			ResponseHeaderTimeout: 10 * time.Second,
+		}},
+		fastHTTP: http.Client{Timeout: 2 * time.Second},
+		waitHTTP: http.Client{},
+		streams:  make(map[string]*podStream),
+	}
+}
+
+// -- Submit
+
+func (b *JobsBackend) Submit(ctx context.Context, job *Job) error {
+
+	// NB! Register before sending, the pod might push the progress even before answering
+	if callbacks != nil {
+		job.Callback = callbacks.register(job.ID)
+		job.CallbackToken = callbacks.Token
+	}
+
+	err := b.submit(ctx, job)
+	if callbacks != nil && err != nil {
+		callbacks.unregister(job.ID)
+	}
+	return err
+}
+
+func (b *JobsBackend) submit(ctx context.Context, job *Job) error {
+
+	// -- create JSON request body
+	body, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBadRequest, err.Error())
+	}
+
+	// -- create HTTP request
+	// NB! The stream might outlive Submit call, so it's bound to its own context
+	streamCtx, cancel, connected := detach(ctx)
+	url := b.Server + "/jobs"
+	req, err := http.NewRequestWithContext(streamCtx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		connected()
+		cancel()
+		return fmt.Errorf("%w: %s", ErrBadRequest, err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream, application/x-ndjson;q=0.9, application/json;q=0.8")
+
+	// -- send request to GPU pod
+	res, err := b.slowHTTP.Do(req)
+	connected()
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	fmt.Printf("\n[ NET ] GPU POST Req was sent") // DEBUG
+	b.advertised(res.Header)
+
+	contentType := res.Header.Get("Content-Type")
+	if res.StatusCode == 200 && isStream(contentType) {
+		b.mu.Lock()
+		b.streams[job.ID] = &podStream{body: res.Body, contentType: contentType, cancel: cancel}
+		b.mu.Unlock()
+		return nil
+	}
+	defer cancel()
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		fmt.Printf("\n[ ERR ] Wrong status code = %d", res.StatusCode) // DEBUG
+		log.Errorw("[ ERR ] Wrong status code while sending new job", "id", job.ID, "code", res.StatusCode)
+		return fmt.Errorf("wrong status code while sending new job: %d", res.StatusCode)
+	}
+
+	// -- the pod knows nothing about callbacks, so it should be polled
+	if callbacks != nil && res.Header.Get("X-Callback") != "accepted" {
+		callbacks.unregister(job.ID)
+	}
+
+	return nil
+}
+
+// -- Stream
+
+func (b *JobsBackend) Stream(ctx context.Context, job *Job, update func(output string) error) error {
+
+	if callbacks != nil {
+		defer callbacks.unregister(job.ID)
+	}
+
+	b.mu.Lock()
+	stream, found := b.streams[job.ID]
+	delete(b.streams, job.ID)
+	b.mu.Unlock()
+
+	if found {
+		err := b.consume(ctx, job, stream, update)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		// the pod might still work on the job, so do not give up
+		log.Infow("[ NET ] Stream was broken, fallback to polling", "id", job.ID, "error", err)
+	} else if notify, found := b.callbacks(job.ID); found {
+		err := b.await(ctx, job, notify, update)
+		if err != errCallbackIdle {
+			return err
+		}
+		log.Infow("[ NET ] Pod is silent, fallback to polling", "id", job.ID)
+	} else if b.wait.Load() == 0 {
+		// wait for 3 sec to provide GPU with some time to start doing the task
+		if err := sleep(ctx, 3000*time.Millisecond); err != nil {
+			return err
+		}
+	}
+
+	return b.poll(ctx, job, update)
+}
+
+// consume reads the streaming answer of the pod until the job is finished
+func (b *JobsBackend) consume(ctx context.Context, job *Job, stream *podStream, update func(output string) error) error {
+	defer stream.cancel()
+	defer stream.body.Close()
+
+	progress := &reporter{update: update}
+	err := readStream(ctx, stream.body, stream.contentType, func(data []byte) error {
+		event := JobEvent{}
+		if err := json.Unmarshal(data, &event); err != nil {
+			log.Errorw("[ ERR ] Problem unmarshalling JSON event", "id", job.ID, "error", err.Error(), "body", data)
+			return nil
+		}
+
+		if event.Output != "" {
+			job.Output = event.Output
+		} else {
+			job.Output += event.Token
+		}
+		if event.Status != "" {
+			job.Status = event.Status
+		}
+
+		return progress.report(job.Output, false)
+	})
+
+	// NB! Pods which only stream might not send the final status at all, so the stream ended cleanly is the end of the job
+	if err == nil || job.Status == "finished" {
+		job.Status = "finished"
+		return progress.report(job.Output, true)
+	}
+	return err
+}
+
+// callbacks returns the channel signalled when the pod pushes the progress of the job
+func (b *JobsBackend) callbacks(id string) (chan struct{}, bool) {
+	if callbacks == nil {
+		return nil, false
+	}
+	return callbacks.progress(id)
+}
+
+// await waits for the pod pushing the progress until the job is finished
+func (b *JobsBackend) await(ctx context.Context, job *Job, notify chan struct{}, update func(output string) error) error {
+	progress := &reporter{update: update}
+	idle := time.NewTimer(callbackIdle)
+	defer idle.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-idle.C:
+			return errCallbackIdle
+		case <-notify:
+			job.Output, job.Status = callbacks.state(job.ID)
+			if job.Status == "finished" {
+				return progress.report(job.Output, true)
+			}
+			if err := progress.report(job.Output, false); err != nil {
+				return err
+			}
+			idle.Reset(callbackIdle)
+		}
+	}
+}
+
+// poll requests the job status until it's finished
+func (b *JobsBackend) poll(ctx context.Context, job *Job, update func(output string) error) error {
+
+	progress := &reporter{update: update}
+
+	var errorAttempts int
+	for {
+
+		// -- hold the request on the pod side while the output is not changed, if supported
+		wait := b.wait.Load()
+		url := b.Server + "/jobs/" + job.ID
+		client := &b.fastHTTP
+		var reqCtx context.Context
+		var cancel context.CancelFunc
+		if wait > 0 {
+			url += "?wait=" + strconv.FormatInt(wait, 10)
+			client = &b.waitHTTP
+			reqCtx, cancel = context.WithTimeout(ctx, time.Duration(wait)*time.Second+2*time.Second)
+		} else {
+			reqCtx, cancel = context.WithCancel(ctx)
+		}
+		started := time.Now()
+
+		req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, url, nil)
+		// There should not be an errors at all
+		if err != nil {
+			cancel()
+			return fmt.Errorf("%w: %s", ErrBadRequest, err.Error())
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		// FIXME: Better and robust handling with error checking and deadlines
+		res, err := client.Do(req)
+		if err != nil {
+			cancel()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			fmt.Printf("\nERROR = %s", err.Error()) // DEBUG
+			log.Errorw("[ ERR ] Problem with HTTP request", "id", job.ID, "error", err.Error())
+			errorAttempts++
+			if errorAttempts > 10 {
+				return err
+			}
+			if err := sleep(ctx, 3000*time.Millisecond); err != nil { // wait in case of problems
+				return err
+			}
+			continue
+		}
+
+		fmt.Printf("\n[ NET ] GPU GET Req was sent") // DEBUG
+
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		cancel()
+		b.advertised(res.Header)
+
+		if res.StatusCode != 200 {
+			fmt.Printf("\n[ ERR ] Wrong status code = %d", res.StatusCode) // DEBUG
+			log.Errorw("[ ERR ] Wrong status code", "id", job.ID, "code", res.StatusCode)
+
+			// Requested ID was not found!
+			// FIXME: Think again about right logic here
+			if res.StatusCode == 404 {
+				return ErrJobNotFound
+			}
+
+			if err := sleep(ctx, 3000*time.Millisecond); err != nil { // wait in case of problems
+				return err
+			}
+			continue
+		}
+
+		if err == nil {
+			err = json.Unmarshal(body, job)
+		}
+		if err != nil {
+			fmt.Printf("\nERROR = %s", err.Error())
+			fmt.Printf("\nBODY = %s", body) // DEBUG
+			log.Errorw("[ ERR ] Problem unmarshalling JSON response", "id", job.ID, "error", err.Error(), "body", body)
+			errorAttempts++
+			if errorAttempts > 8 {
+				return err
+			}
+			if err := sleep(ctx, 3000*time.Millisecond); err != nil { // wait in case of problems
+				return err
+			}
+			continue
+		}
+
+		// FIXME: We need MORE conditions to leave the loop
+		if job.Status == "finished" {
+			fmt.Printf("\njob.Status == finished...")
+			return progress.report(job.Output, true)
+		}
+
+		// with long polling the pod answers on every change, so edits are throttled
+		// and requests are paced to not hammer the pod when it answers immediately
+		if wait > 0 {
+			if err := progress.report(job.Output, false); err != nil {
+				return err
+			}
+			if err := sleep(ctx, longPollPace-time.Since(started)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := progress.report(job.Output, true); err != nil {
+			return err
+		}
+
+		// NB! TG limits are kept by the sender, so this only paces requests to the pod
+		fmt.Printf(" [ WAIT-WHILE-REQ-PROCESSED ] ") // DEBUG
+		if err := sleep(ctx, 3000*time.Millisecond); err != nil {
+			return err
+		}
+	}
+}
+
+// advertised remembers whether the pod supports long polling
+func (b *JobsBackend) advertised(header http.Header) {
+	wait, err := strconv.ParseInt(header.Get("X-Long-Poll"), 10, 64)
+	if err != nil || wait < 0 {
+		wait = 0
+	}
+	if wait > maxLongPoll {
+		wait = maxLongPoll
+	}
+	b.wait.Store(wait)
+}
+
+// -- Cancel
+
+func (b *JobsBackend) Cancel(ctx context.Context, job *Job) error {
+
+	// NB! The job might be stopped before streaming, then nobody else closes the stream
+	b.mu.Lock()
+	stream, found := b.streams[job.ID]
+	delete(b.streams, job.ID)
+	b.mu.Unlock()
+
+	if found {
+		stream.cancel()
+		stream.body.Close()
+	}
+
+	url := b.Server + "/jobs/" + job.ID
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBadRequest, err.Error())
+	}
+
+	res, err := b.fastHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != 200 && res.StatusCode != 204 && res.StatusCode != 404 {
+		return fmt.Errorf("wrong status code while cancelling job: %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// -- Ping
+
+func (b *JobsBackend) Ping(ctx context.Context) error {
+	return ping(ctx, &b.fastHTTP, b.Server+"/health")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAdvertised(t *testing.T) {
+	tests := []struct {
+		header string
+		want   int64
+	}{
+		{"", 0},
+		{"20", 20},
+		{"600", maxLongPoll},
+		{"-1", 0},
+		{"soon", 0},
+	}
+
+	for _, test := range tests {
+		backend := newJobsBackend("http://pod")
+		header := http.Header{}
+		header.Set("X-Long-Poll", test.header)
+		backend.advertised(header)
+		if got := backend.wait.Load(); got != test.want {
+			t.Errorf("X-Long-Poll %q: got %d, want %d", test.header, got, test.want)
+		}
+	}
+}
+
+// The pod answering long polls immediately should not be hammered with requests
+func TestLongPollPacing(t *testing.T) {
+	var mu sync.Mutex
+	var polls []time.Time
+	var queries []string
+
+	pod := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Long-Poll", "5")
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodPost {
+			return
+		}
+
+		mu.Lock()
+		polls = append(polls, time.Now())
+		queries = append(queries, r.URL.RawQuery)
+		count := len(polls)
+		mu.Unlock()
+
+		status := ""
+		if count == 3 {
+			status = "finished"
+		}
+		fmt.Fprintf(w, `{"id":"job","output":"%d","status":"%s"}`, count, status)
+	}))
+	defer pod.Close()
+
+	backend := newJobsBackend(pod.URL)
+	job := &Job{ID: "job", Prompt: "Hi"}
+	if err := backend.Submit(context.Background(), job); err != nil {
+		t.Fatalf("unexpected submit error: %s", err.Error())
+	}
+	if err := backend.Stream(context.Background(), job, func(string) error { return nil }); err != nil {
+		t.Fatalf("unexpected stream error: %s", err.Error())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(polls) != 3 || job.Output != "3" {
+		t.Fatalf("got %d polls with output %q, want 3", len(polls), job.Output)
+	}
+	for i := range polls {
+		if queries[i] != "wait=5" {
+			t.Errorf("poll %d: got query %q, want wait=5", i, queries[i])
+		}
+		if i > 0 && polls[i].Sub(polls[i-1]) < longPollPace-50*time.Millisecond {
+			t.Errorf("poll %d: only %v after the previous one", i, polls[i].Sub(polls[i-1]))
+		}
+	}
+}
+
+// The job stopped before streaming should not leave the stream open
+func TestCancelBeforeStream(t *testing.T) {
+	closed := make(chan struct{}, 2)
+	pod := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		closed <- struct{}{}
+	}))
+	defer pod.Close()
+
+	jobs, openai := newJobsBackend(pod.URL), newOpenAIBackend(pod.URL, "")
+	tests := []struct {
+		backend Backend
+		streams func() int
+	}{
+		{jobs, func() int { jobs.mu.Lock(); defer jobs.mu.Unlock(); return len(jobs.streams) }},
+		{openai, func() int { openai.mu.Lock(); defer openai.mu.Unlock(); return len(openai.streams) }},
+	}
+
+	for _, test := range tests {
+		job := &Job{ID: "job", Prompt: "Hi"}
+		if err := test.backend.Submit(context.Background(), job); err != nil {
+			t.Fatalf("unexpected submit error: %s", err.Error())
+		}
+		if test.streams() != 1 {
+			t.Fatalf("%T: the stream is not kept", test.backend)
+		}
+		test.backend.Cancel(context.Background(), job)
+		if test.streams() != 0 {
+			t.Errorf("%T: the stream is kept after cancel", test.backend)
+		}
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Errorf("%T: the stream is not closed", test.backend)
+		}
+	}
+}
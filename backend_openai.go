@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenAIBackend talks to the servers implementing POST /v1/chat/completions,
+// like vLLM, llama.cpp server or TGI. Those are stateless, so the whole history
+// of the session is sent with every job
+type OpenAIBackend struct {
+	Server string // Pod address like http://127.0.0.1:8000
+	Model  string
+
+	client http.Client
+
+	mu      sync.Mutex
+	streams map[string]*podStream // Jobs in flight by ID
+}
+
+type OpenAIRequest struct {
+	Model    string     `json:"model,omitempty"`
+	Messages []*Message `json:"messages"`
+	Stream   bool       `json:"stream"`
+}
+
+type OpenAIChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+}
+
+func newOpenAIBackend(server, model string) *OpenAIBackend {
+	return &OpenAIBackend{
+		Server: server,
+		Model:  model,
+		// NB! Streaming answers might take minutes, so only the time to get headers is limited
+		client: http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+			ResponseHeaderTimeout: 30 * time.Second, // NB! Some servers process the whole prompt before answering
+		}},
+		streams: make(map[string]*podStream),
+	}
+}
+
+// -- Submit
+
+func (b *OpenAIBackend) Submit(ctx context.Context, job *Job) error {
+
+	messages := append(history(job.Session), &Message{Role: "user", Content: job.Prompt})
+
+	body, err := json.Marshal(OpenAIRequest{
+		Model:    b.Model,
+		Messages: messages,
+		Stream:   true,
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBadRequest, err.Error())
+	}
+
+	// NB! The stream outlives Submit call, so it's bound to its own context
+	streamCtx, cancel, connected := detach(ctx)
+	url := b.Server + "/v1/chat/completions"
+	req, err := http.NewRequestWithContext(streamCtx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		connected()
+		cancel()
+		return fmt.Errorf("%w: %s", ErrBadRequest, err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+
+	res, err := b.client.Do(req)
+	connected()
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	fmt.Printf("\n[ NET ] GPU POST Req was sent") // DEBUG
+
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		cancel()
+		log.Errorw("[ ERR ] Wrong status code while sending new job", "id", job.ID, "code", res.StatusCode)
+		// -- the pod is fine, but the request is not [ like the context is too long ], so other pods would reject it too
+		if res.StatusCode >= 400 && res.StatusCode < 500 && res.StatusCode != 408 && res.StatusCode != 429 {
+			return fmt.Errorf("%w: status code %d", ErrBadRequest, res.StatusCode)
+		}
+		return fmt.Errorf("wrong status code while sending new job: %d", res.StatusCode)
+	}
+
+	b.mu.Lock()
+	b.streams[job.ID] = &podStream{body: res.Body, contentType: "text/event-stream", cancel: cancel}
+	b.mu.Unlock()
+
+	return nil
+}
+
+// -- Stream
+
+func (b *OpenAIBackend) Stream(ctx context.Context, job *Job, update func(output string) error) error {
+
+	b.mu.Lock()
+	stream, found := b.streams[job.ID]
+	b.mu.Unlock()
+
+	if !found {
+		return ErrJobNotFound
+	}
+
+	defer func() {
+		b.mu.Lock()
+		delete(b.streams, job.ID)
+		b.mu.Unlock()
+		stream.body.Close()
+		stream.cancel()
+	}()
+
+	var output strings.Builder
+	progress := &reporter{update: update}
+	done := false // NB! The stream might be cut by the proxy or crashed server without any error
+
+	err := readStream(ctx, stream.body, "text/event-stream", func(data []byte) error {
+		if string(data) == "[DONE]" {
+			done = true
+			return nil
+		}
+
+		chunk := OpenAIChunk{}
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			log.Errorw("[ ERR ] Problem unmarshalling JSON chunk", "id", job.ID, "error", err.Error(), "body", data)
+			return nil
+		}
+		if len(chunk.Choices) == 0 {
+			return nil
+		}
+
+		output.WriteString(chunk.Choices[0].Delta.Content)
+		job.Output = output.String()
+		if chunk.Choices[0].FinishReason != nil {
+			done = true
+		}
+		return progress.report(job.Output, false)
+	})
+
+	if err == nil && !done && ctx.Err() == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Errorw("[ ERR ] Problem reading the stream", "id", job.ID, "error", err.Error())
+		}
+		return err
+	}
+
+	job.Status = "finished"
+	return progress.report(job.Output, true)
+}
+
+// -- Cancel
+
+// Cancel drops the connection, which is the way to abort generation for OpenAI compatible servers
+func (b *OpenAIBackend) Cancel(ctx context.Context, job *Job) error {
+	// NB! The job might be stopped before streaming, then nobody else closes the stream
+	b.mu.Lock()
+	stream, found := b.streams[job.ID]
+	delete(b.streams, job.ID)
+	b.mu.Unlock()
+
+	if found {
+		stream.cancel()
+		stream.body.Close()
+	}
+	return nil
+}
+
+// -- Ping
+
+func (b *OpenAIBackend) Ping(ctx context.Context) error {
+	return ping(ctx, &b.client, b.Server+"/v1/models")
+}
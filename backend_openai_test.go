@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOpenAIBackend(t *testing.T) {
+	tests := []struct {
+		name      string
+		code      int
+		stream    string
+		submitErr error
+		streamErr error
+		output    string
+	}{
+		{
+			name: "finished",
+			code: 200,
+			stream: "data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"}}]}\n\n" +
+				"data: {\"choices\":[{\"delta\":{\"content\":\" world\"}}]}\n\n" +
+				"data: [DONE]\n\n",
+			output: "Hello world",
+		},
+		{
+			name: "finish reason without done",
+			code: 200,
+			stream: "data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"}}]}\n\n" +
+				"data: {\"choices\":[{\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n",
+			output: "Hello",
+		},
+		{
+			name:      "cut stream",
+			code:      200,
+			stream:    "data: {\"choices\":[{\"delta\":{\"content\":\"Hel\"}}]}\n\n",
+			streamErr: io.ErrUnexpectedEOF,
+			output:    "Hel",
+		},
+		{name: "context is too long", code: 400, submitErr: ErrBadRequest},
+		{name: "rate limited", code: 429, submitErr: errPodFailure},
+		{name: "pod failure", code: 500, submitErr: errPodFailure},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.WriteHeader(test.code)
+				fmt.Fprint(w, test.stream)
+			}))
+			defer pod.Close()
+
+			backend := newOpenAIBackend(pod.URL, "model")
+			job := &Job{ID: "job", Prompt: "Hi"}
+			err := backend.Submit(context.Background(), job)
+			switch {
+			case test.submitErr == errPodFailure:
+				if err == nil || errors.Is(err, ErrBadRequest) {
+					t.Fatalf("got submit error %v, want the pod failure", err)
+				}
+				return
+			case test.submitErr != nil:
+				if !errors.Is(err, test.submitErr) {
+					t.Fatalf("got submit error %v, want %v", err, test.submitErr)
+				}
+				return
+			case err != nil:
+				t.Fatalf("unexpected submit error: %s", err.Error())
+			}
+
+			err = backend.Stream(context.Background(), job, func(output string) error { return nil })
+			if !errors.Is(err, test.streamErr) {
+				t.Errorf("got stream error %v, want %v", err, test.streamErr)
+			}
+			if job.Output != test.output {
+				t.Errorf("got output %q, want %q", job.Output, test.output)
+			}
+		})
+	}
+}
+
+// errPodFailure marks any error which is not the bad request
+var errPodFailure = errors.New("pod failure")
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"math/rand"
+)
+
+// Balancer picks the pod for the new session out of healthy candidates.
+// NB! Balancers are called under the global mutex
+type Balancer func(candidates []*Pod) *Pod
+
+var (
+	balancers = map[string]Balancer{
+		"random":   randomBalancer,
+		"weighted": weightedBalancer,
+		"least":    leastBalancer,
+		"p2c":      p2cBalancer,
+	}
+
+	strategies map[string]string // balancer name by mode
+)
+
+func init() {
+	strategies = make(map[string]string)
+}
+
+// pickPod selects one of healthy pods for the mode [ or any pod when all of them are dead ]
+// with the balancer configured for the mode, avoiding excluded pods if possible
+func pickPod(mode string, exclude ...string) string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var candidates, all []*Pod
+	for _, addr := range zoo[mode] {
+		pod, found := pods[addr]
+		if !found || contains(exclude, addr) {
+			continue
+		}
+		all = append(all, pod)
+		if pod.healthy && breaker.available(pod) {
+			candidates = append(candidates, pod)
+		}
+	}
+	if len(candidates) == 0 {
+		log.Errorw("[ ERR ] There no healthy pods", "mode", mode)
+		candidates = all
+	}
+	if len(candidates) == 0 {
+		log.Errorw("[ ERR ] There no pods at all", "mode", mode)
+		return ""
+	}
+
+	balancer, found := balancers[strategies[mode]]
+	if !found {
+		balancer = randomBalancer
+	}
+
+	return balancer(candidates).Addr
+}
+
+// -- In-flight jobs accounting
+
+func podStarted(addr string) {
+	mu.Lock()
+	if pod, found := pods[addr]; found {
+		pod.inflight++
+	}
+	mu.Unlock()
+}
+
+func podFinished(addr string) {
+	mu.Lock()
+	if pod, found := pods[addr]; found && pod.inflight > 0 {
+		pod.inflight--
+	}
+	mu.Unlock()
+}
+
+// -- Strategies
+
+// randomBalancer picks the uniformly random pod whatever its capacity or load
+func randomBalancer(candidates []*Pod) *Pod {
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// weightedBalancer picks the random pod with probability proportional to its declared capacity
+func weightedBalancer(candidates []*Pod) *Pod {
+	total := 0
+	for _, pod := range candidates {
+		total += pod.Weight
+	}
+
+	n := rand.Intn(total)
+	for _, pod := range candidates {
+		if n < pod.Weight {
+			return pod
+		}
+		n -= pod.Weight
+	}
+
+	return candidates[len(candidates)-1]
+}
+
+// leastBalancer picks the pod with the least in-flight jobs per unit of capacity
+func leastBalancer(candidates []*Pod) *Pod {
+	best := candidates[rand.Intn(len(candidates))] // NB! Random start to not overload the first one among equals
+	for _, pod := range candidates {
+		if pod.load() < best.load() {
+			best = pod
+		}
+	}
+	return best
+}
+
+// p2cBalancer picks two random pods and takes the less loaded one,
+// which is almost as good as least loaded, but avoids herding into the same pod
+func p2cBalancer(candidates []*Pod) *Pod {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	n := rand.Intn(len(candidates))
+	first := candidates[n]
+	second := candidates[(n+1+rand.Intn(len(candidates)-1))%len(candidates)]
+	if second.load() < first.load() {
+		return second
+	}
+	return first
+}
+
+// -- Helpers
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBalancers(t *testing.T) {
+	tests := []struct {
+		name     string
+		balancer Balancer
+		pods     []*Pod
+		want     string
+	}{
+		{"least loaded", leastBalancer, []*Pod{
+			{Addr: "a", Weight: 1, inflight: 2},
+			{Addr: "b", Weight: 1, inflight: 1},
+			{Addr: "c", Weight: 1, inflight: 3},
+		}, "b"},
+		{"least loaded per capacity", leastBalancer, []*Pod{
+			{Addr: "a", Weight: 1, inflight: 2},
+			{Addr: "b", Weight: 4, inflight: 4},
+		}, "b"},
+		{"power of two", p2cBalancer, []*Pod{
+			{Addr: "a", Weight: 1, inflight: 5},
+			{Addr: "b", Weight: 1, inflight: 0},
+		}, "b"},
+		{"single pod", p2cBalancer, []*Pod{{Addr: "a", Weight: 1}}, "a"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				if got := test.balancer(test.pods).Addr; got != test.want {
+					t.Fatalf("got pod %q, want %q", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWeightedBalancer(t *testing.T) {
+	candidates := []*Pod{{Addr: "a", Weight: 1}, {Addr: "b", Weight: 3}}
+	picks := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		picks[weightedBalancer(candidates).Addr]++
+	}
+	if share := float64(picks["b"]) / 10000; math.Abs(share-0.75) > 0.05 {
+		t.Errorf("got share %.2f of the heavier pod, want 0.75", share)
+	}
+}
+
+func TestPickPod(t *testing.T) {
+	savedPods, savedZoo := pods, zoo
+	defer func() { pods, zoo = savedPods, savedZoo }()
+
+	tests := []struct {
+		name    string
+		pods    []*Pod
+		exclude []string
+		want    []string // any of them
+	}{
+		{"healthy only", []*Pod{{Addr: "a", Weight: 1}, {Addr: "b", Weight: 1, healthy: true}}, nil, []string{"b"}},
+		{"excluded", []*Pod{{Addr: "a", Weight: 1, healthy: true}, {Addr: "b", Weight: 1, healthy: true}}, []string{"a"}, []string{"b"}},
+		{"all dead", []*Pod{{Addr: "a", Weight: 1}, {Addr: "b", Weight: 1}}, nil, []string{"a", "b"}},
+		{"nothing left", []*Pod{{Addr: "a", Weight: 1, healthy: true}}, []string{"a"}, []string{""}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pods = make(map[string]*Pod)
+			zoo = map[string][]string{"chat": nil}
+			for _, pod := range test.pods {
+				pods[pod.Addr] = pod
+				zoo["chat"] = append(zoo["chat"], pod.Addr)
+			}
+			for i := 0; i < 20; i++ {
+				if got := pickPod("chat", test.exclude...); !contains(test.want, got) {
+					t.Fatalf("got pod %q, want any of %q", got, test.want)
+				}
+			}
+		})
+	}
+}
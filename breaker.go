@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrBreakerOpen = errors.New("circuit breaker is open for the pod")
+
+// CircuitBreaker stops sending jobs to the pod after Failures errors in a row.
+// When Timeout passes, the single probe job is allowed [ half-open state ],
+// and the breaker is closed again if it succeeds
+type CircuitBreaker struct {
+	Failures int
+	Timeout  time.Duration
+}
+
+var breaker *CircuitBreaker
+
+// newCircuitBreaker reads BREAKER_FAILURES and BREAKER_TIMEOUT [ seconds ] settings
+func newCircuitBreaker() *CircuitBreaker {
+	cb := &CircuitBreaker{
+		Failures: envInt("BREAKER_FAILURES", 5),
+		Timeout:  time.Duration(envInt("BREAKER_TIMEOUT", 30)) * time.Second,
+	}
+	if cb.Failures < 1 {
+		cb.Failures = 1
+	}
+	return cb
+}
+
+// available checks whether the pod might get the job without changing its state.
+// NB! Should be called under the global mutex
+func (cb *CircuitBreaker) available(pod *Pod) bool {
+	if cb == nil || pod.failed < cb.Failures {
+		return true
+	}
+	return !pod.probing && time.Now().After(pod.openUntil)
+}
+
+// allow reserves the pod for the job, the only probe job is allowed for the half-open breaker
+func (cb *CircuitBreaker) allow(addr string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	pod, found := pods[addr]
+	if !found || cb == nil {
+		return true
+	}
+	if !cb.available(pod) {
+		return false
+	}
+	if pod.failed >= cb.Failures {
+		pod.probing = true
+		log.Infow("[ POD ] Circuit breaker is half-open, probing the pod", "pod", addr)
+	}
+	return true
+}
+
+// success closes the breaker
+func (cb *CircuitBreaker) success(addr string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	pod, found := pods[addr]
+	if !found || cb == nil {
+		return
+	}
+	if pod.failed >= cb.Failures {
+		fmt.Printf("\n[ POD ] Circuit breaker is closed: %s", addr)
+		log.Infow("[ POD ] Circuit breaker is closed", "pod", addr)
+	}
+	pod.failed = 0
+	pod.probing = false
+}
+
+// failure opens the breaker after too many errors in a row or when the probe job fails
+func (cb *CircuitBreaker) failure(addr string, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	pod, found := pods[addr]
+	if !found || cb == nil {
+		return
+	}
+	pod.failed++
+	pod.probing = false
+	if pod.failed >= cb.Failures {
+		pod.openUntil = time.Now().Add(cb.Timeout)
+		fmt.Printf("\n[ POD ] Circuit breaker is open: %s", addr)
+		log.Errorw("[ POD ] Circuit breaker is open", "pod", addr, "failures", pod.failed, "error", err.Error())
+	}
+}
+
+// release frees the probe reservation when the job was not done for reasons unrelated to the pod,
+// like stopped by the user or the bad request, so the next job probes the pod again
+func (cb *CircuitBreaker) release(addr string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if pod, found := pods[addr]; found && cb != nil {
+		pod.probing = false
+	}
+}
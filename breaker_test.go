@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	savedPods := pods
+	defer func() { pods = savedPods }()
+
+	failure := errors.New("pod failure")
+	cb := &CircuitBreaker{Failures: 2, Timeout: time.Hour}
+
+	tests := []struct {
+		name  string
+		step  func(addr string)
+		allow bool // whether the next job is allowed after the step
+	}{
+		{"closed", func(string) {}, true},
+		{"first failure", func(addr string) { cb.failure(addr, failure) }, true},
+		{"open", func(addr string) { cb.failure(addr, failure) }, false},
+		{"half-open after timeout", func(addr string) { pods[addr].openUntil = time.Now().Add(-time.Second) }, true},
+		{"single probe", func(addr string) { cb.allow(addr) }, false},
+		{"probe is stopped", func(addr string) { cb.release(addr) }, true},
+		{"probe failed", func(addr string) { cb.allow(addr); cb.failure(addr, failure) }, false},
+		{"probe succeeded", func(addr string) {
+			pods[addr].openUntil = time.Now().Add(-time.Second)
+			cb.allow(addr)
+			cb.success(addr)
+		}, true},
+		{"failures are counted again", func(addr string) { cb.failure(addr, failure) }, true},
+	}
+
+	pods = map[string]*Pod{"a": {Addr: "a", Weight: 1}}
+	for _, test := range tests {
+		test.step("a")
+		mu.Lock()
+		got := cb.available(pods["a"])
+		mu.Unlock()
+		if got != test.allow {
+			t.Fatalf("%s: got available %v, want %v", test.name, got, test.allow)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CallbackHub receives job progress pushed by pods with POST /callbacks/jobs/{id},
+// so jobs do not need to poll the pods at all
+type CallbackHub struct {
+	URL   string // Public base address of the listener sent to pods with jobs
+	Token string // Optional shared secret sent to pods with jobs and expected back within Authorization header
+
+	mu   sync.Mutex
+	jobs map[string]*jobProgress
+}
+
+// jobProgress is the last known state of the job, notify channel is signalled on each change
+type jobProgress struct {
+	output string
+	status string
+	notify chan struct{}
+}
+
+var callbacks *CallbackHub // nil when callbacks are disabled
+
+// maxCallbackBody limits the callback size, it's enough for the whole output of any job
+const maxCallbackBody = 1 << 20
+
+// startCallbacks runs HTTP listener for pod callbacks in background
+func startCallbacks(listen, url, token string) *CallbackHub {
+	hub := &CallbackHub{
+		URL:   strings.TrimSuffix(url, "/"),
+		Token: token,
+		jobs:  make(map[string]*jobProgress),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/callbacks/jobs/", hub.handle)
+
+	// NB! The listener is open to the world, so slow or silent clients should not hold connections forever
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
+
+	go func() {
+		err := server.ListenAndServe()
+		fmt.Printf("\n[ ERR ] Callbacks listener was stopped: %s", err.Error())
+		log.Errorw("[ ERR ] Callbacks listener was stopped", "listen", listen, "error", err.Error())
+	}()
+
+	return hub
+}
+
+// register starts waiting for callbacks of the job and returns the URL for the pod
+func (hub *CallbackHub) register(id string) string {
+	hub.mu.Lock()
+	hub.jobs[id] = &jobProgress{notify: make(chan struct{}, 1)}
+	hub.mu.Unlock()
+	return hub.URL + "/callbacks/jobs/" + id
+}
+
+func (hub *CallbackHub) unregister(id string) {
+	hub.mu.Lock()
+	delete(hub.jobs, id)
+	hub.mu.Unlock()
+}
+
+// progress returns the channel signalled on job changes
+func (hub *CallbackHub) progress(id string) (chan struct{}, bool) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	job, found := hub.jobs[id]
+	if !found {
+		return nil, false
+	}
+	return job.notify, true
+}
+
+// state returns the last known output and status of the job
+func (hub *CallbackHub) state(id string) (output, status string) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if job, found := hub.jobs[id]; found {
+		return job.output, job.status
+	}
+	return "", ""
+}
+
+// -- POST /callbacks/jobs/{id}
+
+func (hub *CallbackHub) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if hub.Token != "" && r.Header.Get("Authorization") != "Bearer "+hub.Token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/callbacks/jobs/")
+	event := JobEvent{}
+	body := http.MaxBytesReader(w, r.Body, maxCallbackBody)
+	if err := json.NewDecoder(body).Decode(&event); err != nil {
+		log.Errorw("[ ERR ] Problem unmarshalling JSON callback", "id", id, "error", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	hub.mu.Lock()
+	job, found := hub.jobs[id]
+	if found {
+		if event.Output != "" {
+			job.output = event.Output
+		} else {
+			job.output += event.Token
+		}
+		if event.Status != "" {
+			job.status = event.Status
+		}
+	}
+	hub.mu.Unlock()
+
+	// NB! Pods should stop sending callbacks for unknown jobs
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	select {
+	case job.notify <- struct{}{}:
+	default: // there already pending notification
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
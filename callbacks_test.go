@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCallbackHub(t *testing.T) {
+	hub := &CallbackHub{URL: "http://bot", Token: "secret", jobs: make(map[string]*jobProgress)}
+	if url := hub.register("job"); url != "http://bot/callbacks/jobs/job" {
+		t.Fatalf("got callback URL %q", url)
+	}
+	notify, _ := hub.progress("job")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		auth   string
+		body   string
+		code   int
+		output string
+		status string
+	}{
+		{"wrong method", http.MethodGet, "/callbacks/jobs/job", "Bearer secret", "", 405, "", ""},
+		{"no token", http.MethodPost, "/callbacks/jobs/job", "", `{"token":"x"}`, 401, "", ""},
+		{"wrong token", http.MethodPost, "/callbacks/jobs/job", "Bearer wrong", `{"token":"x"}`, 401, "", ""},
+		{"broken JSON", http.MethodPost, "/callbacks/jobs/job", "Bearer secret", `{"token":`, 400, "", ""},
+		{"too big", http.MethodPost, "/callbacks/jobs/job", "Bearer secret", `{"output":"` + strings.Repeat("x", maxCallbackBody) + `"}`, 400, "", ""},
+		{"unknown job", http.MethodPost, "/callbacks/jobs/other", "Bearer secret", `{"token":"x"}`, 404, "", ""},
+		{"token", http.MethodPost, "/callbacks/jobs/job", "Bearer secret", `{"token":"Hel"}`, 204, "Hel", ""},
+		{"next token", http.MethodPost, "/callbacks/jobs/job", "Bearer secret", `{"token":"lo"}`, 204, "Hello", ""},
+		{"whole output", http.MethodPost, "/callbacks/jobs/job", "Bearer secret", `{"output":"Hello world","status":"finished"}`, 204, "Hello world", "finished"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			if test.auth != "" {
+				req.Header.Set("Authorization", test.auth)
+			}
+			w := httptest.NewRecorder()
+			hub.handle(w, req)
+
+			if w.Code != test.code {
+				t.Fatalf("got code %d, want %d", w.Code, test.code)
+			}
+			if test.code != 204 {
+				return
+			}
+			select {
+			case <-notify:
+			default:
+				t.Errorf("job is not notified")
+			}
+			if output, status := hub.state("job"); output != test.output || status != test.status {
+				t.Errorf("got output %q with status %q, want %q with %q", output, status, test.output, test.status)
+			}
+		})
+	}
+
+	hub.unregister("job")
+	if _, found := hub.progress("job"); found {
+		t.Errorf("job is still registered")
+	}
+}
+
+// Pods should get the callback URL and the token with the job
+func TestCallbackJob(t *testing.T) {
+	var got Job
+	pod := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Header().Set("X-Callback", "accepted")
+		w.Header().Set("Content-Type", "application/json")
+	}))
+	defer pod.Close()
+
+	callbacks = &CallbackHub{URL: "http://bot", Token: "secret", jobs: make(map[string]*jobProgress)}
+	defer func() { callbacks = nil }()
+
+	job := &Job{ID: "job", Prompt: "Hi"}
+	if err := newJobsBackend(pod.URL).Submit(context.Background(), job); err != nil {
+		t.Fatalf("unexpected submit error: %s", err.Error())
+	}
+	if got.Callback != "http://bot/callbacks/jobs/job" || got.CallbackToken != "secret" {
+		t.Errorf("got callback %q with token %q", got.Callback, got.CallbackToken)
+	}
+	if _, found := callbacks.progress("job"); !found {
+		t.Errorf("job is not registered")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ConfigReport collects problems found within settings, any error is fatal
+type ConfigReport struct {
+	Errors   []string
+	Warnings []string
+}
+
+func (report *ConfigReport) errorf(format string, args ...any) {
+	report.Errors = append(report.Errors, fmt.Sprintf(format, args...))
+}
+
+func (report *ConfigReport) warnf(format string, args ...any) {
+	report.Warnings = append(report.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Fatal tells whether the bot should refuse to start with such settings
+func (report *ConfigReport) Fatal() bool {
+	return len(report.Errors) > 0
+}
+
+// Print shows the report on the console and writes it into the log
+func (report *ConfigReport) Print() {
+	for _, warning := range report.Warnings {
+		fmt.Printf("\n[ CONFIG ] WARN  %s", warning)
+		log.Warnw("[ CONFIG ] Warning", "problem", warning)
+	}
+	for _, err := range report.Errors {
+		fmt.Printf("\n[ CONFIG ] ERROR %s", err)
+		log.Errorw("[ CONFIG ] Error", "problem", err)
+	}
+	if report.Fatal() {
+		fmt.Printf("\n[ CONFIG ] %d errors and %d warnings found", len(report.Errors), len(report.Warnings))
+		return
+	}
+	fmt.Printf("\n[ CONFIG ] Settings are OK [ %d warnings ]", len(report.Warnings))
+}
+
+// validateConfig checks all settings before they are applied
+func validateConfig() *ConfigReport {
+	report := &ConfigReport{}
+
+	if os.Getenv("TELEGRAM_TOKEN") == "" {
+		report.errorf("TELEGRAM_TOKEN is empty")
+	}
+
+	// -- every mode should have at least one pod, each address should be valid and unique
+
+	declared := make(map[string]*Pod)
+	for _, mode := range []string{"chat", "pro"} {
+		name := strings.ToUpper(mode) + "ZOO"
+		seen := make(map[string]bool)
+		count := 0
+
+		list := os.Getenv(name)
+		if strings.TrimSpace(list) == "" {
+			report.errorf("%s is empty, there should be at least one pod for %s mode", name, mode)
+			continue
+		}
+
+		for i, entry := range strings.Split(list, ",") {
+			if strings.TrimSpace(entry) == "" {
+				report.errorf("%s: entry #%d is empty", name, i+1)
+				continue
+			}
+
+			pod, err := parsePod(entry)
+			if err != nil {
+				report.errorf("%s: entry #%d %q: %s", name, i+1, entry, err.Error())
+				continue
+			}
+
+			if seen[pod.Addr] {
+				report.errorf("%s: duplicate pod %s", name, pod.Addr)
+				continue
+			}
+			seen[pod.Addr] = true
+			count++
+
+			// NB! Pods are known by address, so the same box should be declared the same way within all modes
+			if prev, found := declared[pod.Addr]; found && (prev.Protocol != pod.Protocol || prev.Model != pod.Model) {
+				report.errorf("%s: pod %s is declared with different protocol or model within other mode", name, pod.Addr)
+			}
+			declared[pod.Addr] = pod
+		}
+
+		if count == 0 {
+			report.errorf("%s: there should be at least one pod for %s mode", name, mode)
+		}
+
+		balancer := strings.ToUpper(mode) + "BALANCER"
+		if strategy := os.Getenv(balancer); strategy != "" {
+			if _, found := balancers[strategy]; !found {
+				report.errorf("%s: unknown balancer %q [ random / weighted / least / p2c ]", balancer, strategy)
+			}
+		}
+
+		if _, err := parseFilters(modeFiltersSpec(mode)); err != nil {
+			report.errorf("%sFILTERS: %s", strings.ToUpper(mode), err.Error())
+		}
+	}
+
+	// -- output filters of models
+
+	models := make(map[string]bool)
+	for _, pod := range declared {
+		if pod.Model == "" || models[pod.Model] {
+			continue
+		}
+		models[pod.Model] = true
+		name := modelFiltersName(pod.Model)
+		if _, err := parseFilters(os.Getenv(name)); err != nil {
+			report.errorf("%s: %s", name, err.Error())
+		}
+	}
+
+	if mode := os.Getenv("FORMAT"); mode != "" && mode != "html" && mode != "entities" {
+		report.errorf("FORMAT: unknown format mode %q [ html / entities ]", mode)
+	}
+
+	// -- callbacks are useless when pods do not know where to push
+
+	if os.Getenv("CALLBACK_LISTEN") != "" && os.Getenv("CALLBACK_URL") == "" {
+		report.errorf("CALLBACK_URL should be set together with CALLBACK_LISTEN")
+	}
+	if os.Getenv("CALLBACK_LISTEN") != "" && os.Getenv("CALLBACK_TOKEN") == "" {
+		report.warnf("CALLBACK_TOKEN is empty, anyone might push fake job progress")
+	}
+
+	return report
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	valid := map[string]string{
+		"TELEGRAM_TOKEN": "token",
+		"CHATZOO":        "http://10.0.0.1:8080,openai+http://10.0.0.2:8000|model=llama|weight=2",
+		"PROZOO":         "http://10.0.0.1:8080",
+	}
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		errors   []string // parts of expected errors
+		warnings int
+	}{
+		{name: "valid", env: valid},
+		{name: "no token", env: map[string]string{"TELEGRAM_TOKEN": ""}, errors: []string{"TELEGRAM_TOKEN"}},
+		{name: "empty zoo", env: map[string]string{"PROZOO": " "}, errors: []string{"PROZOO is empty"}},
+		{name: "empty entry", env: map[string]string{"PROZOO": "http://10.0.0.1:8080,"}, errors: []string{"entry #2 is empty"}},
+		{name: "wrong address", env: map[string]string{"PROZOO": "10.0.0.1:8080"}, errors: []string{"PROZOO: entry #1", "at least one pod"}},
+		{name: "duplicate pod", env: map[string]string{"PROZOO": "http://10.0.0.1:8080,http://10.0.0.1:8080/"}, errors: []string{"duplicate pod"}},
+		{name: "pod declared differently", env: map[string]string{"PROZOO": "openai+http://10.0.0.1:8080"}, errors: []string{"different protocol or model"}},
+		{name: "unknown balancer", env: map[string]string{"CHATBALANCER": "fastest"}, errors: []string{"unknown balancer"}},
+		{name: "wrong mode filters", env: map[string]string{"PROFILTERS": "shout"}, errors: []string{"PROFILTERS"}},
+		{name: "wrong model filters", env: map[string]string{"FILTERS_LLAMA": "stop:"}, errors: []string{"FILTERS_LLAMA"}},
+		{name: "unknown format", env: map[string]string{"FORMAT": "markdown"}, errors: []string{"FORMAT"}},
+		{name: "callbacks without URL", env: map[string]string{"CALLBACK_LISTEN": ":8081", "CALLBACK_TOKEN": "secret"}, errors: []string{"CALLBACK_URL"}},
+		{name: "callbacks without token", env: map[string]string{"CALLBACK_LISTEN": ":8081", "CALLBACK_URL": "http://bot"}, warnings: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"CHATBALANCER", "PROBALANCER", "CHATFILTERS", "PROFILTERS", "FILTERS_LLAMA",
+				"FORMAT", "CALLBACK_LISTEN", "CALLBACK_URL", "CALLBACK_TOKEN"} {
+				t.Setenv(name, "")
+			}
+			for name, value := range valid {
+				t.Setenv(name, value)
+			}
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			report := validateConfig()
+			if len(report.Errors) != len(test.errors) {
+				t.Fatalf("got errors %q, want %q", report.Errors, test.errors)
+			}
+			for i, part := range test.errors {
+				if !strings.Contains(report.Errors[i], part) {
+					t.Errorf("got error %q, want %q within", report.Errors[i], part)
+				}
+			}
+			if len(report.Warnings) != test.warnings {
+				t.Errorf("got warnings %q, want %d", report.Warnings, test.warnings)
+			}
+		})
+	}
+}
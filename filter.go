@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Filter post-processes the output of the model before it's converted and shown to the user.
+// NB! Filters get the whole output produced so far with every streamed chunk, so they should not keep any state.
+// The final output is marked, as there nothing more to wait for
+type Filter func(output string, final bool) string
+
+// Filters is the chain applied in order
+type Filters []Filter
+
+func (chain Filters) apply(output string, final bool) string {
+	for _, filter := range chain {
+		output = filter(output, final)
+	}
+	return output
+}
+
+// Chains are declared per mode with CHATFILTERS / PROFILTERS and per model with FILTERS_<MODEL>,
+// where the model name is upper cased with all other symbols replaced by underscores. Filters are separated
+// with semicolons [ escaped as \; within arguments ], for example:
+//
+//	CHATFILTERS=stop:<|eot_id|>;prefix:Assistant:;spaces;replace:/\bChatGPT\b/Мира/
+//	FILTERS_LLAMA_3_8B=stop:<|im_end|>
+//
+// The model chain goes after the mode one
+var (
+	modeFilters  map[string]Filters // guarded by the global mutex
+	modelFilters map[string]Filters // guarded by the global mutex
+)
+
+// defaultFilters are used for modes without CHATFILTERS / PROFILTERS
+const defaultFilters = `stop:<|im_end|>;stop:<|eot_id|>`
+
+func init() {
+	modeFilters = make(map[string]Filters)
+	modelFilters = make(map[string]Filters)
+}
+
+// filtersFor returns the chain for the mode and the model of the pod
+func filtersFor(mode, server string) Filters {
+	mu.Lock()
+	defer mu.Unlock()
+
+	chain := append(Filters{}, modeFilters[mode]...)
+	if pod, found := pods[server]; found && pod.Model != "" {
+		chain = append(chain, modelFilters[pod.Model]...)
+	}
+	return chain
+}
+
+// loadFilters reads all chains from settings, broken ones are logged and skipped.
+// NB! Should be called under the global mutex
+func loadFilters() {
+	for _, mode := range []string{"chat", "pro"} {
+		chain, err := parseFilters(modeFiltersSpec(mode))
+		if err != nil {
+			log.Errorw("[ ERR ] Wrong filters", "mode", mode, "error", err.Error())
+		}
+		modeFilters[mode] = chain
+	}
+
+	modelFilters = make(map[string]Filters)
+	for _, pod := range pods {
+		if pod.Model == "" {
+			continue
+		}
+		chain, err := parseFilters(os.Getenv(modelFiltersName(pod.Model)))
+		if err != nil {
+			log.Errorw("[ ERR ] Wrong filters", "model", pod.Model, "error", err.Error())
+		}
+		modelFilters[pod.Model] = chain
+	}
+}
+
+// modeFiltersSpec returns the settings of the mode chain
+func modeFiltersSpec(mode string) string {
+	spec, found := os.LookupEnv(strings.ToUpper(mode) + "FILTERS")
+	if !found {
+		return defaultFilters
+	}
+	return spec
+}
+
+// modelFiltersName returns the name of settings for the model chain
+func modelFiltersName(model string) string {
+	name := strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, model)
+	return "FILTERS_" + name
+}
+
+// parseFilters builds the chain from settings, returning all the filters which were parsed right
+func parseFilters(spec string) (Filters, error) {
+	var chain Filters
+	var errs []string
+
+	for _, item := range splitFilters(spec) {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		name, arg, _ := strings.Cut(item, ":")
+		filter, err := newFilter(strings.TrimSpace(name), arg)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%q: %s", item, err.Error()))
+			continue
+		}
+		chain = append(chain, filter)
+	}
+
+	if len(errs) > 0 {
+		return chain, fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return chain, nil
+}
+
+// splitFilters splits the chain by semicolons, which are not escaped
+func splitFilters(spec string) []string {
+	var items []string
+	var item strings.Builder
+	for i := 0; i < len(spec); i++ {
+		switch {
+		case spec[i] == '\\' && i+1 < len(spec) && spec[i+1] == ';':
+			item.WriteByte(';')
+			i++
+		case spec[i] == ';':
+			items = append(items, item.String())
+			item.Reset()
+		default:
+			item.WriteByte(spec[i])
+		}
+	}
+	return append(items, item.String())
+}
+
+func newFilter(name, arg string) (Filter, error) {
+	switch name {
+	case "stop":
+		if arg == "" {
+			return nil, fmt.Errorf("empty stop token")
+		}
+		return stopFilter(arg), nil
+	case "prefix":
+		if strings.TrimSpace(arg) == "" {
+			return nil, fmt.Errorf("empty prefix")
+		}
+		return prefixFilter(strings.TrimSpace(arg)), nil
+	case "spaces":
+		return spacesFilter, nil
+	case "replace":
+		return replaceFilter(arg)
+	}
+	return nil, fmt.Errorf("unknown filter [ stop / prefix / spaces / replace ]")
+}
+
+// stopFilter cuts the output at the stop token. The beginning of the token at the very end
+// is hidden too while streaming, as the rest of it might come with the next chunk
+func stopFilter(token string) Filter {
+	return func(output string, final bool) string {
+		if pos := strings.Index(output, token); pos >= 0 {
+			return output[:pos]
+		}
+		if final {
+			return output
+		}
+		for size := len(token) - 1; size > 1; size-- {
+			if strings.HasSuffix(output, token[:size]) {
+				return output[:len(output)-size]
+			}
+		}
+		return output
+	}
+}
+
+// prefixFilter drops the role prefix like "Assistant:" the model might start the answer with
+func prefixFilter(prefix string) Filter {
+	return func(output string, final bool) string {
+		trimmed := strings.TrimLeftFunc(output, unicode.IsSpace)
+		// NB! Lower case might take more or less bytes for non-ASCII symbols, so the output is compared in place
+		switch {
+		case len(trimmed) >= len(prefix) && strings.EqualFold(trimmed[:len(prefix)], prefix):
+			return strings.TrimLeftFunc(trimmed[len(prefix):], unicode.IsSpace)
+		case len(trimmed) < len(prefix) && strings.EqualFold(trimmed, prefix[:len(trimmed)]) && !final:
+			return "" // NB! The prefix is not complete yet, while the final output is the answer as it is
+		}
+		return output
+	}
+}
+
+var blankLinesRe = regexp.MustCompile(`\n{3,}`)
+
+// spacesFilter drops trailing spaces of lines, leading blank lines and collapses runs of blank lines
+func spacesFilter(output string, final bool) string {
+	lines := strings.Split(output, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRightFunc(line, unicode.IsSpace)
+	}
+	output = strings.Join(lines, "\n")
+	output = blankLinesRe.ReplaceAllString(output, "\n\n")
+	return strings.TrimLeft(output, "\n")
+}
+
+// replaceFilter replaces regular expression declared like /regexp/replacement/, any other delimiter might be used
+func replaceFilter(arg string) (Filter, error) {
+	if len(arg) < 3 {
+		return nil, fmt.Errorf("should look like /regexp/replacement/")
+	}
+	parts := strings.Split(arg[1:], arg[:1])
+	if len(parts) != 3 || parts[2] != "" {
+		return nil, fmt.Errorf("should look like /regexp/replacement/")
+	}
+	re, err := regexp.Compile(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	replacement := parts[1]
+	return func(output string, final bool) string {
+		return re.ReplaceAllString(output, replacement)
+	}, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestFilters(t *testing.T) {
+	tests := []struct {
+		name   string
+		spec   string
+		output string
+		final  bool
+		want   string
+	}{
+		{"stop token", "stop:<|im_end|>", "Hello<|im_end|>junk", true, "Hello"},
+		{"partial stop token while streaming", "stop:<|im_end|>", "Hello<|im", false, "Hello"},
+		{"partial stop token at the end", "stop:<|im_end|>", "Hello<|im", true, "Hello<|im"},
+		{"prefix", "prefix:Assistant:", "  assistant: Hi", true, "Hi"},
+		{"partial prefix while streaming", "prefix:Assistant:", "Assis", false, ""},
+		{"partial prefix at the end", "prefix:Assistant:", "As", true, "As"},
+		{"no prefix", "prefix:Assistant:", "Hello", false, "Hello"},
+		{"cyrillic prefix", "prefix:Ассистент:", "АССИСТЕНТ: Привет", true, "Привет"},
+		{"partial cyrillic prefix while streaming", "prefix:Ассистент:", "асси", false, ""},
+		{"cyrillic text without prefix", "prefix:Ассистент:", "Ассорти", true, "Ассорти"},
+		{"wider symbol in lower case", "prefix:ok:", "O\u212A: Hi", true, "O\u212A: Hi"}, // Kelvin sign
+		{"spaces", "spaces", "\n\nline  \n\n\n\nnext", true, "line\n\nnext"},
+		{"replace", `replace:/\bChatGPT\b/Мира/`, "I am ChatGPT", true, "I am Мира"},
+		{"escaped semicolon", `replace:/\;/\;\;/`, "a;b", true, "a;;b"},
+		{"chain in order", "stop:<|eot_id|>;prefix:Assistant:;spaces", "Assistant: Hi  <|eot_id|>", true, "Hi"},
+		{"empty chain", "", "as is ", true, "as is "},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chain, err := parseFilters(test.spec)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if got := chain.apply(test.output, test.final); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseFiltersErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  string
+		valid int
+	}{
+		{"unknown filter", "stop:x;shout", 1},
+		{"empty stop token", "stop:", 0},
+		{"empty prefix", "prefix: ", 0},
+		{"broken replace", "replace:/a/", 0},
+		{"broken regexp", "replace:/(/x/;spaces", 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chain, err := parseFilters(test.spec)
+			if err == nil {
+				t.Errorf("want error")
+			}
+			if len(chain) != test.valid {
+				t.Errorf("got %d filters, want %d", len(chain), test.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// Flight is the job in flight persisted with the user, so it's resumed after restart
+type Flight struct {
+	JobID       string    `json:"id"`
+	Prompt      string    `json:"prompt"`
+	Session     string    `json:"session"`
+	Server      string    `json:"server"`                // The pod doing the job
+	Frozen      int       `json:"frozen,omitempty"`      // Parts of the output already frozen in earlier messages
+	MessageID   int       `json:"msg,omitempty"`         // TG message with the tail of the output, zero when nothing was sent yet
+	ChatID      int64     `json:"chat,omitempty"`        // TG chat of that message
+	Placeholder bool      `json:"placeholder,omitempty"` // That message shows the placeholder only
+	Output      string    `json:"output,omitempty"`      // Raw output the user sees right now
+	Started     time.Time `json:"started"`
+}
+
+// takeOff remembers the job submitted to the pod, along with the placeholder shown to the user
+func (user *User) takeOff(job *Job, server string, answer *Answer) {
+	mu.Lock()
+	user.Flight = &Flight{
+		JobID:   job.ID,
+		Prompt:  job.Prompt,
+		Session: job.Session,
+		Server:  server,
+		Started: time.Now(),
+	}
+	mu.Unlock()
+
+	user.progress(job.ID, answer, "")
+}
+
+// progress remembers the partial output shown to the user
+func (user *User) progress(id string, answer *Answer, output string) {
+	number, chatID := 0, int64(0)
+	if answer.tail != nil {
+		var messageID string
+		messageID, chatID = answer.tail.MessageSig()
+		number, _ = strconv.Atoi(messageID)
+	}
+
+	mu.Lock()
+	if user.Flight != nil && user.Flight.JobID == id {
+		user.Flight.Frozen = answer.frozen
+		user.Flight.MessageID = number
+		user.Flight.ChatID = chatID
+		user.Flight.Placeholder = answer.placeholder
+		user.Flight.Output = output
+	}
+	mu.Unlock()
+}
+
+// land forgets the job which is done one way or another.
+// NB! Should be called under the global mutex
+func (user *User) land(id string) {
+	if user.Flight != nil && user.Flight.JobID == id {
+		user.Flight = nil
+	}
+}
+
+// resumeFlights continues all jobs which were in flight when the bot was stopped
+func resumeFlights() {
+	for _, user := range users.List() {
+		mu.Lock()
+		flight := user.Flight
+		mu.Unlock()
+
+		if flight != nil {
+			go resume(user, flight)
+		}
+	}
+}
+
+// resume polls the pod for the job in flight and finishes the partially streamed message
+func resume(user *User, flight *Flight) {
+	id := flight.JobID
+	job := &Job{
+		ID:      id,
+		Prompt:  flight.Prompt,
+		Session: flight.Session,
+		Output:  flight.Output,
+	}
+
+	fmt.Printf("\n[ RESUME ] Job %s of user %d", id, user.TGID)
+	log.Infow("[ RESUME ] Resume the job in flight", "user", user.TGID, "id", id, "server", flight.Server,
+		"started", flight.Started)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mu.Lock()
+	user.Status = "processing"
+	user.job = job
+	user.stop = cancel
+	mu.Unlock()
+
+	defer func() {
+		mu.Lock()
+		if user.job == job {
+			user.job = nil
+			user.stop = nil
+		}
+		user.land(id)
+		user.Status = ""
+		mu.Unlock()
+	}()
+
+	stopMarkup := &tele.ReplyMarkup{}
+	stopMarkup.Inline(stopMarkup.Row(stopMarkup.Data("⏹ Стоп", "stop", id)))
+
+	// -- continue the answer right where it was stopped
+
+	to := &tele.User{ID: user.TGID}
+	go sender.Typing(ctx, to)
+	answer := newAnswer(to, stopMarkup)
+	if flight.MessageID != 0 {
+		tail := &tele.StoredMessage{MessageID: strconv.Itoa(flight.MessageID), ChatID: flight.ChatID}
+		answer.restore(flight.Frozen, tail, flight.Output, flight.Placeholder)
+	} else {
+		answer.restore(flight.Frozen, nil, flight.Output, false)
+	}
+
+	// -- the pod might be dropped from the zoo while the bot was down
+
+	backend := newBackend(flight.Server)
+	filters := filtersFor(user.Mode, flight.Server)
+	err := ErrJobNotFound
+	if isPodActive(user.Mode, flight.Server) {
+		podStarted(flight.Server)
+		err = backend.Stream(ctx, job, func(output string) error {
+			output = filters.apply(output, false)
+			if err := answer.Update(output); err != nil {
+				log.Errorw("[ ERR ] Problem sending resumed message", "id", id, "error", err.Error())
+				return nil // NB! The next update will try again
+			}
+			user.progress(id, answer, output)
+			return nil
+		})
+		podFinished(flight.Server)
+		job.Output = filters.apply(job.Output, true)
+	}
+
+	// -- drop the Stop button, keeping all the output produced so far
+
+	if answer.Sent() {
+		if err := answer.Finish(job.Output); err != nil {
+			log.Errorw("[ ERR ] Problem editing resumed message", "id", id, "error", err.Error())
+		}
+	}
+
+	if ctx.Err() != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := backend.Cancel(ctx, job); err != nil {
+				log.Errorw("[ ERR ] Problem cancelling the job", "id", id, "error", err.Error())
+			}
+		}()
+		if !answer.Sent() {
+			answer.Say("Остановлено.")
+		}
+		err = nil
+	}
+
+	if err != nil {
+		log.Errorw("[ ERR ] Can't resume the job in flight", "id", id, "error", err.Error())
+		if errors.Is(err, ErrJobNotFound) {
+			answer.Say("Ответ был прерван перезапуском, попробуйте еще раз...")
+		} else {
+			answer.Say("Проблемы со связью, попробуйте еще раз...")
+		}
+		return
+	}
+
+	session := findSession(user, flight.Session)
+	session.record(flight.Prompt, job.Output, flight.Server)
+	user.answered(job.Output)
+
+	log.Infow("[ RESUME ] Resumed message finished", "id", id)
+}
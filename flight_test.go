@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// fakeTelegram records Bot API calls and answers them like Telegram does
+type fakeTelegram struct {
+	mu     sync.Mutex
+	calls  []tgCall
+	floods int // how many next calls are answered with 429
+	next   int // the last message ID
+}
+
+type tgCall struct {
+	method    string
+	chat      string
+	messageID string
+	text      string
+	at        time.Time
+}
+
+func newFakeTelegram(t *testing.T) (*fakeTelegram, *tele.Bot) {
+	t.Helper()
+	tg := &fakeTelegram{next: 100}
+	server := httptest.NewServer(http.HandlerFunc(tg.handle))
+	t.Cleanup(server.Close)
+
+	bot, err := tele.NewBot(tele.Settings{URL: server.URL, Token: "token", Offline: true})
+	if err != nil {
+		t.Fatalf("can't create bot: %s", err.Error())
+	}
+	return tg, bot
+}
+
+func (tg *fakeTelegram) handle(w http.ResponseWriter, r *http.Request) {
+	params := make(map[string]any)
+	json.NewDecoder(r.Body).Decode(&params)
+	call := tgCall{
+		method:    r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:],
+		chat:      fmt.Sprint(params["chat_id"]),
+		messageID: fmt.Sprint(params["message_id"]),
+		text:      fmt.Sprint(params["text"]),
+		at:        time.Now(),
+	}
+
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+
+	if tg.floods > 0 {
+		tg.floods--
+		call.method += ":429"
+		tg.calls = append(tg.calls, call)
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 1","parameters":{"retry_after":1}}`)
+		return
+	}
+	if call.method == "sendChatAction" {
+		tg.calls = append(tg.calls, call)
+		fmt.Fprint(w, `{"ok":true,"result":true}`)
+		return
+	}
+	tg.calls = append(tg.calls, call)
+
+	id := call.messageID
+	if call.method == "sendMessage" {
+		tg.next++
+		id = fmt.Sprint(tg.next)
+	}
+	text, _ := json.Marshal(call.text)
+	fmt.Fprintf(w, `{"ok":true,"result":{"message_id":%s,"chat":{"id":%s},"text":%s}}`, id, call.chat, text)
+}
+
+// sent returns all calls except chat actions
+func (tg *fakeTelegram) sent() []tgCall {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	var calls []tgCall
+	for _, call := range tg.calls {
+		if call.method != "sendChatAction" {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+func TestResume(t *testing.T) {
+	savedPods, savedZoo, savedSender := pods, zoo, sender
+	defer func() { pods, zoo, sender = savedPods, savedZoo, savedSender }()
+
+	pod := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id":"job","output":"Hello world","status":"finished"}`)
+	}))
+	defer pod.Close()
+
+	tests := []struct {
+		name   string
+		active bool
+		flight Flight
+		want   []tgCall // method, message and text
+		output string   // recorded into the session
+	}{
+		{
+			name:   "partially shown",
+			active: true,
+			flight: Flight{MessageID: 10, ChatID: 1, Output: "Hello"},
+			want:   []tgCall{{method: "editMessageText", messageID: "10", text: "Hello world"}},
+			output: "Hello world",
+		},
+		{
+			name:   "nothing shown yet",
+			active: true,
+			want: []tgCall{
+				{method: "sendMessage", text: "Hello world"},
+				{method: "editMessageText", messageID: "101", text: "Hello world"}, // drops the Stop button
+			},
+			output: "Hello world",
+		},
+		{
+			name:   "placeholder shown",
+			active: true,
+			flight: Flight{MessageID: 10, ChatID: 1, Placeholder: true},
+			want:   []tgCall{{method: "editMessageText", messageID: "10", text: "Hello world"}},
+			output: "Hello world",
+		},
+		{
+			name:   "placeholder and pod is gone",
+			flight: Flight{MessageID: 10, ChatID: 1, Placeholder: true},
+			want: []tgCall{
+				{method: "editMessageText", messageID: "10", text: "Ответ был прерван перезапуском, попробуйте еще раз..."},
+			},
+		},
+		{
+			name:   "pod is gone",
+			flight: Flight{MessageID: 10, ChatID: 1, Output: "Hello"},
+			want: []tgCall{
+				{method: "editMessageText", messageID: "10", text: "Hello"},
+				{method: "sendMessage", text: "Ответ был прерван перезапуском, попробуйте еще раз..."},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tg, bot := newFakeTelegram(t)
+			sender = newSender(bot)
+
+			backend := newJobsBackend(pod.URL)
+			backend.wait.Store(1) // NB! No need to wait before polling
+			pods = map[string]*Pod{pod.URL: {Addr: pod.URL, Weight: 1, healthy: true, backend: backend}}
+			zoo = map[string][]string{"chat": nil}
+			if test.active {
+				zoo["chat"] = []string{pod.URL}
+			}
+
+			flight := test.flight
+			flight.JobID, flight.Prompt, flight.Session, flight.Server = "job", "Hi", "resumed-"+test.name, pod.URL
+			user := &User{TGID: 1, Mode: "chat", SessionID: flight.Session, Flight: &flight}
+			resume(user, &flight)
+
+			if user.Flight != nil || user.Status != "" || user.job != nil {
+				t.Errorf("the job is still in flight: %+v", user)
+			}
+
+			calls := tg.sent()
+			if len(calls) != len(test.want) {
+				t.Fatalf("got calls %+v, want %+v", calls, test.want)
+			}
+			for i, want := range test.want {
+				got := calls[i]
+				if got.method != want.method || got.text != want.text || want.messageID != "" && got.messageID != want.messageID {
+					t.Errorf("call %d: got %s [ %s ] %q, want %s [ %s ] %q", i,
+						got.method, got.messageID, got.text, want.method, want.messageID, want.text)
+				}
+			}
+
+			session := findSession(user, flight.Session)
+			if test.output == "" {
+				if len(session.Outputs) != 0 {
+					t.Errorf("the broken answer is recorded: %q", session.Outputs)
+				}
+				return
+			}
+			if len(session.Outputs) != 1 || session.Outputs[0] != test.output || session.Prompts[0] != "Hi" {
+				t.Errorf("got session %+v, want output %q", session, test.output)
+			}
+		})
+	}
+}
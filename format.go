@@ -0,0 +1,389 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// Models answer with GitHub flavoured Markdown, which differs a lot from TG dialects of Markdown,
+// so the output is converted into TG HTML, where only <, > and & should be escaped
+
+var (
+	headingRe = regexp.MustCompile(`^#{1,6}\s+(.*?)\s*#*$`)
+	bulletRe  = regexp.MustCompile(`^(\s*)[-*+]\s+(.*)$`)
+	orderedRe = regexp.MustCompile(`^(\s*)(\d+[.)])\s+(.*)$`)
+	ruleRe    = regexp.MustCompile(`^(\s*[-*_]\s*){3,}$`)
+	quoteRe   = regexp.MustCompile(`^\s*>\s?(.*)$`)
+
+	escaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+)
+
+// formatHTML converts Markdown into TG HTML: headings, lists, quotes, fenced and inline code, links,
+// emphasis and tables. Anything else is kept as the plain text, escaped properly
+func formatHTML(text string) string {
+	var out []string
+	lines := strings.Split(text, "\n")
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+
+		// -- fenced code, the block which is not closed yet is closed anyway, as the output might be still streamed
+		case strings.HasPrefix(trimmed, "```"):
+			lang := strings.TrimSpace(strings.Trim(trimmed, "`"))
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			out = append(out, preHTML(strings.Join(code, "\n"), lang))
+
+		// -- tables are shown as preformatted text with aligned columns
+		case strings.HasPrefix(trimmed, "|"):
+			var rows []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), "|"); i++ {
+				rows = append(rows, strings.TrimSpace(lines[i]))
+			}
+			i--
+			out = append(out, preHTML(formatTable(rows), ""))
+
+		// -- quotes are joined into the single block
+		case quoteRe.MatchString(line):
+			var quote []string
+			for ; i < len(lines) && quoteRe.MatchString(lines[i]); i++ {
+				quote = append(quote, inlineHTML(quoteRe.FindStringSubmatch(lines[i])[1]))
+			}
+			i--
+			out = append(out, "<blockquote>"+strings.Join(quote, "\n")+"</blockquote>")
+
+		case ruleRe.MatchString(line) && strings.Trim(trimmed, "-*_ ") == "":
+			out = append(out, "——————")
+
+		case headingRe.MatchString(trimmed):
+			out = append(out, "<b>"+inlineHTML(headingRe.FindStringSubmatch(trimmed)[1])+"</b>")
+
+		case bulletRe.MatchString(line):
+			match := bulletRe.FindStringSubmatch(line)
+			out = append(out, match[1]+"• "+inlineHTML(match[2]))
+
+		case orderedRe.MatchString(line):
+			match := orderedRe.FindStringSubmatch(line)
+			out = append(out, match[1]+match[2]+" "+inlineHTML(match[3]))
+
+		default:
+			out = append(out, inlineHTML(line))
+		}
+	}
+
+	return strings.Join(out, "\n")
+}
+
+// preHTML wraps the code into the preformatted block
+func preHTML(code, lang string) string {
+	if lang != "" {
+		return `<pre><code class="language-` + html.EscapeString(lang) + `">` + escaper.Replace(code) + "</code></pre>"
+	}
+	return "<pre>" + escaper.Replace(code) + "</pre>"
+}
+
+// formatTable aligns columns of Markdown table, dropping the separator row
+func formatTable(rows []string) string {
+	var cells [][]string
+	var widths []int
+	for _, row := range rows {
+		row = strings.TrimSuffix(strings.TrimPrefix(row, "|"), "|")
+		if strings.Trim(row, "|-: ") == "" {
+			continue
+		}
+		var cols []string
+		for j, col := range strings.Split(row, "|") {
+			col = strings.TrimSpace(col)
+			cols = append(cols, col)
+			if j >= len(widths) {
+				widths = append(widths, 0)
+			}
+			if width := utf8.RuneCountInString(col); width > widths[j] {
+				widths[j] = width
+			}
+		}
+		cells = append(cells, cols)
+	}
+
+	var lines, compact []string
+	for _, cols := range cells {
+		compact = append(compact, strings.Join(cols, " | "))
+		for j, col := range cols {
+			cols[j] = col + strings.Repeat(" ", widths[j]-utf8.RuneCountInString(col))
+		}
+		lines = append(lines, strings.TrimRight(strings.Join(cols, " | "), " "))
+	}
+
+	// NB! The single wide cell makes all rows as wide as it, so such tables are not aligned,
+	// as the message should never get longer than the markup it's made of
+	table := strings.Join(lines, "\n")
+	if utf8.RuneCountInString(table) > utf8.RuneCountInString(strings.Join(rows, "\n")) {
+		return strings.Join(compact, "\n")
+	}
+	return table
+}
+
+// inlineHTML converts the inline markup: code, links, bold, italic and strikethrough.
+// Markers without the pair are kept as is, as the output might be still streamed
+func inlineHTML(text string) string {
+	var out strings.Builder
+
+	for i := 0; i < len(text); {
+		rest := text[i:]
+
+		switch {
+
+		case rest[0] == '`':
+			if end := strings.IndexByte(rest[1:], '`'); end > 0 {
+				out.WriteString("<code>" + escaper.Replace(rest[1:end+1]) + "</code>")
+				i += end + 2
+				continue
+			}
+
+		case rest[0] == '[':
+			if label, url, size, found := parseLink(rest); found {
+				out.WriteString(`<a href="` + html.EscapeString(url) + `">` + inlineHTML(label) + "</a>")
+				i += size
+				continue
+			}
+
+		case strings.HasPrefix(rest, "**") || strings.HasPrefix(rest, "__"):
+			if inner, size, found := emphasis(text, i, rest[:2]); found {
+				out.WriteString("<b>" + inlineHTML(inner) + "</b>")
+				i += size
+				continue
+			}
+
+		case strings.HasPrefix(rest, "~~"):
+			if inner, size, found := emphasis(text, i, "~~"); found {
+				out.WriteString("<s>" + inlineHTML(inner) + "</s>")
+				i += size
+				continue
+			}
+
+		case rest[0] == '*' || rest[0] == '_':
+			if inner, size, found := emphasis(text, i, rest[:1]); found {
+				out.WriteString("<i>" + inlineHTML(inner) + "</i>")
+				i += size
+				continue
+			}
+		}
+
+		r, size := utf8.DecodeRuneInString(rest)
+		out.WriteString(escaper.Replace(string(r)))
+		i += size
+	}
+
+	return out.String()
+}
+
+// parseLink parses [label](url) at the start of the text
+func parseLink(text string) (label, url string, size int, found bool) {
+	end := strings.Index(text, "](")
+	if end < 0 {
+		return "", "", 0, false
+	}
+	close := strings.IndexByte(text[end+2:], ')')
+	if close <= 0 {
+		return "", "", 0, false
+	}
+	label, url = text[1:end], text[end+2:end+2+close]
+	if strings.ContainsAny(url, " \t") || strings.Contains(label, "[") {
+		return "", "", 0, false
+	}
+	return label, url, end + 3 + close, true
+}
+
+// emphasis finds the pair for the marker at the given position and returns the text between them.
+// The marker should be followed by non space, and the pair should follow non space.
+// NB! Underscores within words like snake_case are not the markup
+func emphasis(text string, pos int, marker string) (inner string, size int, found bool) {
+	start := pos + len(marker)
+	if start >= len(text) || text[start] == ' ' || strings.HasPrefix(text[start:], marker[:1]) {
+		return "", 0, false
+	}
+	if marker[0] == '_' && pos > 0 && isWordByte(text, pos-1) {
+		return "", 0, false
+	}
+
+	for from := start + 1; from < len(text); {
+		end := strings.Index(text[from:], marker)
+		if end < 0 {
+			return "", 0, false
+		}
+		end += from
+		after := end + len(marker)
+
+		switch {
+		case text[end-1] == ' ':
+		case len(marker) == 1 && after < len(text) && text[after] == marker[0]: // part of the longer marker
+			from = after + 1
+			continue
+		case marker[0] == '_' && after < len(text) && isWordByte(text, after):
+		default:
+			return text[start:end], after - pos, true
+		}
+		from = end + 1
+	}
+
+	return "", 0, false
+}
+
+// isWordByte checks whether there the letter or digit at the given position of the text
+func isWordByte(text string, pos int) bool {
+	r, _ := utf8.DecodeRuneInString(text[pos:])
+	if r == utf8.RuneError {
+		r, _ = utf8.DecodeLastRuneInString(text[:pos+1])
+	}
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// plainText strips HTML tags and entities, it's the fallback when TG rejects the markup
+func plainText(text string) string {
+	var out strings.Builder
+	tag := false
+	for _, r := range text {
+		switch {
+		case r == '<':
+			tag = true
+		case r == '>' && tag:
+			tag = false
+		case !tag:
+			out.WriteRune(r)
+		}
+	}
+	return html.UnescapeString(out.String())
+}
+
+// -- Entities
+
+// formatMode tells how formatted messages are sent to TG: as HTML or as the plain text with entities.
+// NB! Entities can't be broken, so the partial output is always shown safely
+var formatMode = "html"
+
+// formatted returns the text of the message formatted with TG HTML and send options for the current format mode
+func formatted(text string, opts ...any) (string, []any) {
+	if formatMode != "entities" {
+		return text, append(opts, tele.ModeHTML)
+	}
+
+	plain, entities := htmlEntities(text)
+	if len(entities) > 0 {
+		opts = append(opts, entities)
+	}
+	return plain, opts
+}
+
+// htmlEntities converts TG HTML made by formatHTML into the plain text and entities.
+// Tags which are not closed yet are closed implicitly at the end of the text
+func htmlEntities(text string) (string, tele.Entities) {
+	type span struct {
+		entity tele.MessageEntity
+		tag    string
+	}
+
+	var out strings.Builder
+	var entities tele.Entities
+	var open []*span
+	offset := 0 // in UTF-16 code units
+
+	closeSpan := func(span *span) {
+		span.entity.Length = offset - span.entity.Offset
+		if span.entity.Length > 0 && span.entity.Type != "" {
+			entities = append(entities, span.entity)
+		}
+	}
+
+	for len(text) > 0 {
+
+		// -- text till the next tag
+		end := strings.IndexByte(text, '<')
+		if end != 0 {
+			if end < 0 {
+				end = len(text)
+			}
+			chunk := html.UnescapeString(text[:end])
+			out.WriteString(chunk)
+			for _, r := range chunk {
+				offset += utf16.RuneLen(r)
+			}
+			text = text[end:]
+			continue
+		}
+
+		// -- the tag
+		end = strings.IndexByte(text, '>')
+		if end < 0 {
+			break
+		}
+		tag := text[1:end]
+		text = text[end+1:]
+
+		if name, closing := strings.CutPrefix(tag, "/"); closing {
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i].tag == name {
+					closeSpan(open[i])
+					open = append(open[:i], open[i+1:]...)
+					break
+				}
+			}
+			continue
+		}
+
+		name, attrs, _ := strings.Cut(tag, " ")
+		entity := tele.MessageEntity{Offset: offset}
+		switch name {
+		case "b":
+			entity.Type = tele.EntityBold
+		case "i":
+			entity.Type = tele.EntityItalic
+		case "s":
+			entity.Type = tele.EntityStrikethrough
+		case "pre":
+			entity.Type = tele.EntityCodeBlock
+		case "blockquote":
+			entity.Type = tele.EntityType("blockquote")
+		case "a":
+			entity.Type = tele.EntityTextLink
+			entity.URL = html.UnescapeString(attribute(attrs, "href"))
+		case "code":
+			// NB! The code within the preformatted block sets the language of the block
+			if len(open) > 0 && open[len(open)-1].tag == "pre" {
+				language := attribute(attrs, "class")
+				open[len(open)-1].entity.Language = strings.TrimPrefix(html.UnescapeString(language), "language-")
+			} else {
+				entity.Type = tele.EntityCode
+			}
+		}
+		open = append(open, &span{entity: entity, tag: name})
+	}
+
+	for i := len(open) - 1; i >= 0; i-- {
+		closeSpan(open[i])
+	}
+
+	sort.SliceStable(entities, func(i, j int) bool { return entities[i].Offset < entities[j].Offset })
+	return out.String(), entities
+}
+
+// attribute returns the value of the quoted attribute of HTML tag
+func attribute(attrs, name string) string {
+	_, value, found := strings.Cut(attrs, name+`="`)
+	if !found {
+		return ""
+	}
+	value, _, _ = strings.Cut(value, `"`)
+	return value
+}
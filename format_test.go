@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+func TestFormatHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"heading", "# Title", "<b>Title</b>"},
+		{"emphasis", "**bold** and *it*", "<b>bold</b> and <i>it</i>"},
+		{"strikethrough", "~~gone~~", "<s>gone</s>"},
+		{"escaping", "a < b & c > d", "a &lt; b &amp; c &gt; d"},
+		{"lists", "- one\n* two\n1. three", "• one\n• two\n1. three"},
+		{"quote", "> quote\n> more", "<blockquote>quote\nmore</blockquote>"},
+		{"rule", "---", "——————"},
+		{"code block", "```go\nx := a < b\n```", `<pre><code class="language-go">x := a &lt; b</code></pre>`},
+		{"code block not closed yet", "```py\nprint(1)", `<pre><code class="language-py">print(1)</code></pre>`},
+		{"inline code", "`code <b>`", "<code>code &lt;b&gt;</code>"},
+		{"link", "[link](http://x.com/?a=1&b=2)", `<a href="http://x.com/?a=1&amp;b=2">link</a>`},
+		{"snake case", "snake_case_name", "snake_case_name"},
+		{"marker without pair", "**unclosed", "**unclosed"},
+		{"table", "| a | bb |\n|---|---|\n| ccc | d |", "<pre>a   | bb\nccc | d</pre>"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := formatHTML(test.text); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHTMLEntities(t *testing.T) {
+	tests := []struct {
+		name     string
+		html     string
+		text     string
+		entities tele.Entities
+	}{
+		{
+			name:     "bold",
+			html:     "<b>bold</b> plain",
+			text:     "bold plain",
+			entities: tele.Entities{{Type: tele.EntityBold, Offset: 0, Length: 4}},
+		},
+		{
+			name:     "offsets in UTF-16",
+			html:     "😀 <i>ит</i>",
+			text:     "😀 ит",
+			entities: tele.Entities{{Type: tele.EntityItalic, Offset: 3, Length: 2}},
+		},
+		{
+			name:     "escaped text",
+			html:     "a &amp; <code>b</code>",
+			text:     "a & b",
+			entities: tele.Entities{{Type: tele.EntityCode, Offset: 4, Length: 1}},
+		},
+		{
+			name:     "code block with language",
+			html:     `<pre><code class="language-go">x &lt; y</code></pre>`,
+			text:     "x < y",
+			entities: tele.Entities{{Type: tele.EntityCodeBlock, Offset: 0, Length: 5, Language: "go"}},
+		},
+		{
+			name:     "link",
+			html:     `<a href="http://x.com/?a=1&amp;b=2">link</a>`,
+			text:     "link",
+			entities: tele.Entities{{Type: tele.EntityTextLink, Offset: 0, Length: 4, URL: "http://x.com/?a=1&b=2"}},
+		},
+		{
+			name:     "quote",
+			html:     "<blockquote>q</blockquote>",
+			text:     "q",
+			entities: tele.Entities{{Type: tele.EntityType("blockquote"), Offset: 0, Length: 1}},
+		},
+		{
+			name:     "tag not closed yet",
+			html:     "<b>unclosed",
+			text:     "unclosed",
+			entities: tele.Entities{{Type: tele.EntityBold, Offset: 0, Length: 8}},
+		},
+		{
+			name: "plain text",
+			html: "just text",
+			text: "just text",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			text, entities := htmlEntities(test.html)
+			if text != test.text {
+				t.Errorf("got text %q, want %q", text, test.text)
+			}
+			if !reflect.DeepEqual(entities, test.entities) {
+				t.Errorf("got entities %+v, want %+v", entities, test.entities)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HealthChecker probes all pods of the zoo in background. The pod is marked unhealthy
+// after Fall failed probes in a row, and healthy again only after Rise successful ones,
+// so flapping boxes do not get new sessions
+type HealthChecker struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	Rise     int
+	Fall     int
+}
+
+// newHealthChecker reads HEALTH_INTERVAL [ seconds, zero disables checks ], HEALTH_RISE and HEALTH_FALL settings
+func newHealthChecker() *HealthChecker {
+	checker := &HealthChecker{
+		Interval: time.Duration(envInt("HEALTH_INTERVAL", 10)) * time.Second,
+		Rise:     envInt("HEALTH_RISE", 2),
+		Fall:     envInt("HEALTH_FALL", 3),
+	}
+
+	checker.Timeout = checker.Interval
+	if checker.Timeout > 5*time.Second {
+		checker.Timeout = 5 * time.Second
+	}
+	if checker.Rise < 1 {
+		checker.Rise = 1
+	}
+	if checker.Fall < 1 {
+		checker.Fall = 1
+	}
+
+	return checker
+}
+
+// Start probes pods at the configured interval until the process is stopped
+func (checker *HealthChecker) Start() {
+	if checker.Interval <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			checker.probe()
+			time.Sleep(checker.Interval)
+		}
+	}()
+}
+
+// probe checks all the pods in parallel
+func (checker *HealthChecker) probe() {
+	mu.Lock()
+	list := make([]*Pod, 0, len(pods))
+	for _, pod := range pods {
+		list = append(list, pod)
+	}
+	mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, pod := range list {
+		wg.Add(1)
+		go func(pod *Pod) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), checker.Timeout)
+			defer cancel()
+			checker.record(pod, pod.backend.Ping(ctx))
+		}(pod)
+	}
+	wg.Wait()
+}
+
+// record updates the pod state with the result of the probe
+func (checker *HealthChecker) record(pod *Pod, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err == nil {
+		pod.failures = 0
+		pod.successes++
+		if !pod.healthy && pod.successes >= checker.Rise {
+			pod.healthy = true
+			fmt.Printf("\n[ POD ] Pod is healthy again: %s", pod.Addr)
+			log.Infow("[ POD ] Pod is healthy again", "pod", pod.Addr)
+		}
+		return
+	}
+
+	pod.successes = 0
+	pod.failures++
+	if pod.healthy && pod.failures >= checker.Fall {
+		pod.healthy = false
+		fmt.Printf("\n[ POD ] Pod is unhealthy: %s", pod.Addr)
+		log.Errorw("[ POD ] Pod is unhealthy", "pod", pod.Addr, "error", err.Error())
+	}
+}
+
+// isPodHealthy reports the last known health of the pod, unknown pods are treated as dead
+func isPodHealthy(addr string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	pod, found := pods[addr]
+	return found && pod.healthy
+}
+
+// -- Helpers
+
+// envInt reads the integer setting, falling back to default value
+func envInt(name string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return value
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// HistoryRecord is the line of append-only history file: either the turn of the dialog,
+// or the fork of the new session which inherits all the history of parent one
+type HistoryRecord struct {
+	Session string    `json:"session"`
+	Parent  string    `json:"parent,omitempty"`
+	TGID    string    `json:"tgid,omitempty"`
+	Prompt  string    `json:"prompt,omitempty"`
+	Output  string    `json:"output,omitempty"`
+	Server  string    `json:"server,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// historyCompaction is how often sessions left by users are dropped from memory and from the history file
+const historyCompaction = time.Hour
+
+var (
+	historyMu   sync.Mutex
+	historyFile *os.File
+	historyPath string
+)
+
+// openHistory restores all the sessions from the history file and opens it for appending new turns.
+// The file is compacted right away and then periodically, so it keeps only sessions of users
+func openHistory(path string) error {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	mu.Lock()
+	for scanner.Scan() {
+		record := HistoryRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil || record.Session == "" {
+			continue
+		}
+		restore(&record)
+		count++
+	}
+	mu.Unlock()
+
+	file.Close()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	log.Infow("[ START ] History was loaded", "records", count, "sessions", len(sessions))
+
+	historyPath = path
+	if err := compact(); err != nil {
+		log.Errorw("[ ERR ] Can't compact history file", "error", err.Error())
+	}
+
+	historyFile, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			time.Sleep(historyCompaction)
+			if err := compactHistory(); err != nil {
+				fmt.Printf("\n[ ERR ] Can't compact history file: %s", err.Error())
+				log.Errorw("[ ERR ] Can't compact history file", "error", err.Error())
+			}
+		}
+	}()
+
+	return nil
+}
+
+// restore applies the history record to the sessions in memory.
+// NB! Should be called under the global mutex
+func restore(record *HistoryRecord) {
+	session, found := sessions[record.Session]
+	if !found {
+		session = &Session{
+			TGID:      record.TGID,
+			SessionID: record.Session,
+		}
+		sessions[record.Session] = session
+	}
+
+	if record.Parent != "" {
+		if parent, found := sessions[record.Parent]; found {
+			session.Prompts = append([]string{}, parent.Prompts...)
+			session.Outputs = append([]string{}, parent.Outputs...)
+		}
+		return
+	}
+
+	session.Prompts = append(session.Prompts, record.Prompt)
+	session.Outputs = append(session.Outputs, record.Output)
+	session.Server = record.Server
+	session.trim()
+}
+
+// appendHistory persists the record, problems are logged, but do not break the dialog
+func appendHistory(record *HistoryRecord) {
+	historyMu.Lock()
+	writeHistory(record)
+	historyMu.Unlock()
+}
+
+// writeHistory appends the record to the file. NB! Should be called under the history mutex
+func writeHistory(record *HistoryRecord) {
+	if historyFile == nil {
+		return
+	}
+
+	record.Time = time.Now()
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Errorw("[ ERR ] Problem marshalling history record", "session", record.Session, "error", err.Error())
+		return
+	}
+
+	if _, err = historyFile.Write(append(data, '\n')); err != nil {
+		log.Errorw("[ ERR ] Problem writing history file", "session", record.Session, "error", err.Error())
+	}
+}
+
+// compactHistory drops sessions left by users and rewrites the history file with the rest of them
+func compactHistory() error {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	if historyFile == nil {
+		return nil
+	}
+	if err := compact(); err != nil {
+		return err
+	}
+
+	// -- the older file is gone, so new turns go into the compacted one
+	historyFile.Close()
+	var err error
+	historyFile, err = os.OpenFile(historyPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	return err
+}
+
+// compact drops sessions which are not used by any user and writes the last turns of others into the new file,
+// which replaces the older one atomically. NB! Should be called under the history mutex
+func compact() error {
+	live := make(map[string]bool)
+	for _, user := range users.List() {
+		mu.Lock()
+		live[user.SessionID] = true
+		if user.Flight != nil {
+			live[user.Flight.Session] = true
+		}
+		mu.Unlock()
+	}
+
+	var records []*HistoryRecord
+	mu.Lock()
+	dropped := 0
+	for id, session := range sessions {
+		if !live[id] {
+			delete(sessions, id)
+			dropped++
+			continue
+		}
+		for i, prompt := range session.Prompts {
+			record := &HistoryRecord{Session: id, TGID: session.TGID, Prompt: prompt, Server: session.Server}
+			if i < len(session.Outputs) {
+				record.Output = session.Outputs[i]
+			}
+			records = append(records, record)
+		}
+	}
+	mu.Unlock()
+
+	tmp := historyPath + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	now := time.Now() // NB! Time of turns is not kept in memory, so it's the time of compaction
+	for _, record := range records {
+		record.Time = now
+		data, err := json.Marshal(record)
+		if err != nil {
+			continue
+		}
+		writer.Write(append(data, '\n'))
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, historyPath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	log.Infow("[ HISTORY ] History was compacted", "records", len(records), "dropped", dropped)
+	return syncDir(filepath.Dir(historyPath))
+}
+
+// closeHistory flushes the history file on shutdown
+func closeHistory() {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	if historyFile != nil {
+		historyFile.Sync()
+		historyFile.Close()
+		historyFile = nil
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// Sessions left by users are dropped, and only the last turns are kept in memory and in the file
+func TestHistoryCompaction(t *testing.T) {
+	savedUsers, savedSessions := users, sessions
+	defer func() { users, sessions = savedUsers, savedSessions }()
+
+	path := filepath.Join(t.TempDir(), "telezoo.history")
+	users = newMemoryStore()
+	sessions = make(map[string]*Session)
+	if err := openHistory(path); err != nil {
+		t.Fatalf("can't open history: %s", err.Error())
+	}
+
+	user := &User{TGID: 1, Mode: "chat", SessionID: "old"}
+	users.Put(user)
+	for i := 0; i < 3; i++ {
+		getSession(user).record(fmt.Sprintf("old %d", i), "answer", "http://pod")
+	}
+
+	user.SessionID = "current"
+	for i := 0; i < maxHistory; i++ {
+		getSession(user).record(fmt.Sprintf("prompt %d", i), fmt.Sprintf("output %d", i), "http://pod")
+	}
+	if got := len(sessions["current"].Prompts); got != maxHistory/2 {
+		t.Errorf("got %d turns in memory, want %d", got, maxHistory/2)
+	}
+
+	if err := compactHistory(); err != nil {
+		t.Fatalf("can't compact history: %s", err.Error())
+	}
+	if _, found := sessions["old"]; found {
+		t.Errorf("the session left by the user is kept")
+	}
+	getSession(user).record("after compaction", "output", "http://pod")
+	closeHistory()
+
+	// -- the file keeps the same turns
+	sessions = make(map[string]*Session)
+	if err := openHistory(path); err != nil {
+		t.Fatalf("can't open history: %s", err.Error())
+	}
+	defer closeHistory()
+
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(sessions))
+	}
+	messages := history("current")
+	if len(messages) != maxHistory {
+		t.Fatalf("got %d messages, want %d", len(messages), maxHistory)
+	}
+	if first, last := messages[0].Content, messages[len(messages)-2].Content; first != "prompt 17" || last != "after compaction" {
+		t.Errorf("got turns from %q to %q", first, last)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// JournalEvent is the line of append-only journal with the change of the user.
+// It carries all journaled fields, so the last event of the user is always the latest state
+type JournalEvent struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`              // new / update / delete
+	Changes  []string  `json:"changes,omitempty"` // which fields were changed with update
+	TGID     int64     `json:"tgid"`
+	Username string    `json:"username,omitempty"`
+	Mode     string    `json:"mode,omitempty"`
+	Server   string    `json:"server,omitempty"`
+	Session  string    `json:"session,omitempty"`
+}
+
+// Journal records every change of users between snapshots, it's replayed on top of the last snapshot on startup.
+// Events covered by snapshots are moved into the archive [ .archive file ], which is never truncated
+// and serves as the audit trail
+type Journal struct {
+	Path string
+
+	mu   sync.Mutex
+	file *os.File
+	last map[int64]*JournalEvent // the latest journaled state of each user
+}
+
+func newJournal(path string) *Journal {
+	return &Journal{
+		Path: path,
+		last: make(map[int64]*JournalEvent),
+	}
+}
+
+// replay applies all the journal on top of users loaded from the snapshot and opens it for appending
+func (journal *Journal) replay(store *MemoryStore) error {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+
+	// -- the snapshot is the base, so users from there are not new
+	for _, user := range store.List() {
+		journal.last[user.TGID] = eventOf(user)
+	}
+
+	file, err := os.OpenFile(journal.Path, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		event := &JournalEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil || event.TGID == 0 {
+			continue
+		}
+		count++
+
+		if event.Kind == "delete" {
+			store.Delete(event.TGID)
+			delete(journal.last, event.TGID)
+			continue
+		}
+
+		user, found := store.Get(event.TGID)
+		if !found {
+			user = &User{TGID: event.TGID}
+			store.Put(user)
+		}
+		user.Username = event.Username
+		user.Mode = event.Mode
+		user.Server = event.Server
+		user.SessionID = event.Session
+		journal.last[event.TGID] = event
+	}
+
+	file.Close()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	log.Infow("[ START ] Journal was replayed", "events", count)
+
+	journal.file, err = os.OpenFile(journal.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	return err
+}
+
+// record appends the event if any journaled field of the user was changed
+func (journal *Journal) record(user *User) error {
+	event := eventOf(user)
+
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+
+	prev, found := journal.last[user.TGID]
+	if !found {
+		event.Kind = "new"
+	} else {
+		event.Kind = "update"
+		if prev.Username != event.Username {
+			event.Changes = append(event.Changes, "username")
+		}
+		if prev.Mode != event.Mode {
+			event.Changes = append(event.Changes, "mode")
+		}
+		if prev.Server != event.Server {
+			event.Changes = append(event.Changes, "server")
+		}
+		if prev.Session != event.Session {
+			event.Changes = append(event.Changes, "session")
+		}
+		if len(event.Changes) == 0 {
+			return nil
+		}
+	}
+
+	journal.last[user.TGID] = event
+	return journal.append(event)
+}
+
+// forget appends the event about removed user
+func (journal *Journal) forget(tgid int64) error {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+
+	delete(journal.last, tgid)
+	return journal.append(&JournalEvent{Time: time.Now(), Kind: "delete", TGID: tgid})
+}
+
+// append writes the event durably. NB! Should be called under the journal mutex
+func (journal *Journal) append(event *JournalEvent) error {
+	if journal.file == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := journal.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return journal.file.Sync()
+}
+
+// mark returns the size of the journal, all events before it are covered by the snapshot started right after
+func (journal *Journal) mark() int64 {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+
+	if journal.file == nil {
+		return 0
+	}
+	info, err := journal.file.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// rotate moves events before the mark into the archive when the snapshot is saved, keeping only events
+// which might be missed by it. NB! The journal is replaced atomically, so the crash in the middle leaves
+// the whole older one, which is still fine to replay [ but those events might be archived twice ]
+func (journal *Journal) rotate(mark int64) error {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+
+	if journal.file == nil || mark == 0 {
+		return nil
+	}
+
+	src, err := os.Open(journal.Path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// -- archive first, so events are never lost
+	if err := journal.archive(io.LimitReader(src, mark)); err != nil {
+		return err
+	}
+	if _, err := src.Seek(mark, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmp := journal.Path + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, journal.Path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := syncDir(filepath.Dir(journal.Path)); err != nil {
+		log.Errorw("[ ERR ] Can't sync journal directory", "error", err.Error())
+	}
+
+	// -- the older file is gone, so new events go into the rotated one
+	journal.file.Close()
+	journal.file, err = os.OpenFile(journal.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	return err
+}
+
+// archive appends events to the audit trail durably
+func (journal *Journal) archive(events io.Reader) error {
+	file, err := os.OpenFile(journal.Path+".archive", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, events)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// close flushes the journal on shutdown
+func (journal *Journal) close() {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+
+	if journal.file != nil {
+		journal.file.Sync()
+		journal.file.Close()
+		journal.file = nil
+	}
+}
+
+func eventOf(user *User) *JournalEvent {
+	return &JournalEvent{
+		Time:     time.Now(),
+		TGID:     user.TGID,
+		Username: user.Username,
+		Mode:     user.Mode,
+		Server:   user.Server,
+		Session:  user.SessionID,
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Changes after the snapshot should survive within the journal
+func TestJournalRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, journalPath := filepath.Join(dir, "telezoo.db"), filepath.Join(dir, "telezoo.journal")
+
+	store := newFileStore(dbPath, journalPath)
+	if err := store.Load(); err != nil {
+		t.Fatalf("can't load empty store: %s", err.Error())
+	}
+
+	store.Put(&User{TGID: 1, Username: "one", Mode: "chat", Messages: 3})
+	store.Put(&User{TGID: 2, Username: "two", Mode: "pro"})
+	store.Put(&User{TGID: 3, Username: "three", Mode: "chat"})
+	if err := store.Save(); err != nil {
+		t.Fatalf("can't save snapshot: %s", err.Error())
+	}
+	if lines := journalLines(t, journalPath); lines != 0 {
+		t.Errorf("journal should be rotated with the snapshot, got %d events", lines)
+	}
+
+	// -- changes after the snapshot go into the journal only
+	user, _ := store.Get(2)
+	user.Mode = "chat"
+	user.SessionID = "s2"
+	store.Put(user)
+	store.Put(user) // nothing is changed
+	store.Delete(3)
+	store.Put(&User{TGID: 4, Username: "four", Mode: "pro"})
+	if lines := journalLines(t, journalPath); lines != 3 {
+		t.Errorf("got %d journal events, want 3", lines)
+	}
+
+	// -- all events are kept within the archive
+	if err := store.Save(); err != nil {
+		t.Fatalf("can't save snapshot: %s", err.Error())
+	}
+	if lines := journalLines(t, journalPath+".archive"); lines != 6 {
+		t.Errorf("got %d archived events, want 6", lines)
+	}
+	store.journal.close()
+
+	restored := newFileStore(dbPath, journalPath)
+	if err := restored.Load(); err != nil {
+		t.Fatalf("can't load store: %s", err.Error())
+	}
+	defer restored.journal.close()
+
+	tests := []struct {
+		tgid  int64
+		found bool
+		want  User
+	}{
+		{1, true, User{TGID: 1, Username: "one", Mode: "chat", Messages: 3}},
+		{2, true, User{TGID: 2, Username: "two", Mode: "chat", SessionID: "s2"}},
+		{3, false, User{}},
+		{4, true, User{TGID: 4, Username: "four", Mode: "pro"}},
+	}
+	for _, test := range tests {
+		user, found := restored.Get(test.tgid)
+		if found != test.found {
+			t.Errorf("user %d: found %v, want %v", test.tgid, found, test.found)
+			continue
+		}
+		if !found {
+			continue
+		}
+		if got, want := mustEncode(t, user), mustEncode(t, &test.want); !bytes.Equal(got, want) {
+			t.Errorf("user %d:\n got %s\nwant %s", test.tgid, got, want)
+		}
+	}
+}
+
+// The crash between the snapshot and the journal rotation leaves older events, which should be replayed safely
+func TestJournalReplay(t *testing.T) {
+	tests := []struct {
+		name     string
+		snapshot string
+		journal  string
+		want     map[int64]string // mode by user
+	}{
+		{
+			name:     "no journal",
+			snapshot: `{"version":2,"tgid":1,"mode":"chat"}`,
+			want:     map[int64]string{1: "chat"},
+		},
+		{
+			name:     "older events",
+			snapshot: `{"version":2,"tgid":1,"mode":"pro"}`,
+			journal: `{"kind":"new","tgid":1,"mode":"chat"}
+{"kind":"update","changes":["mode"],"tgid":1,"mode":"pro"}`,
+			want: map[int64]string{1: "pro"},
+		},
+		{
+			name:     "new and deleted users",
+			snapshot: `{"version":2,"tgid":1,"mode":"chat"}`,
+			journal: `{"kind":"new","tgid":2,"mode":"pro"}
+{"kind":"delete","tgid":1}`,
+			want: map[int64]string{2: "pro"},
+		},
+		{
+			name:     "broken lines",
+			snapshot: `{"version":2,"tgid":1,"mode":"chat"}`,
+			journal: `{"kind":"update","tgid":1,"mode":"pro"}
+{"kind":"upd`,
+			want: map[int64]string{1: "pro"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			dbPath, journalPath := filepath.Join(dir, "telezoo.db"), filepath.Join(dir, "telezoo.journal")
+			writeFile(t, dbPath, test.snapshot)
+			if test.journal != "" {
+				writeFile(t, journalPath, test.journal)
+			}
+
+			store := newFileStore(dbPath, journalPath)
+			if err := store.Load(); err != nil {
+				t.Fatalf("can't load store: %s", err.Error())
+			}
+			defer store.journal.close()
+
+			got := make(map[int64]string)
+			for _, user := range store.List() {
+				got[user.TGID] = user.Mode
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("got users %v, want %v", got, test.want)
+			}
+			for tgid, mode := range test.want {
+				if got[tgid] != mode {
+					t.Errorf("user %d: got mode %q, want %q", tgid, got[tgid], mode)
+				}
+			}
+		})
+	}
+}
+
+func journalLines(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("can't read journal: %s", err.Error())
+	}
+	return bytes.Count(data, []byte("\n"))
+}
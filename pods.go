@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Pod describes the single GPU box within the zoo.
+// Zoo entries are declared like [protocol+]address[|option=value...], for example:
+//
+//	CHATZOO=http://10.0.0.1:8080,openai+http://10.0.0.2:8000|model=llama-3-8b|weight=8
+type Pod struct {
+	Addr     string // Base address for sticky sessions, like http://10.0.0.1:8080
+	Protocol string // jobs / openai
+	Model    string // Model name requested from OpenAI compatible servers
+	Weight   int    // Declared capacity relative to other pods, like the number of GPUs
+
+	backend Backend
+
+	// NB! Health state is guarded by the global mutex
+	healthy   bool // Pods are treated as healthy until the checker proves otherwise
+	successes int  // Successful probes in a row
+	failures  int  // Failed probes in a row
+
+	inflight int // Jobs being processed right now, guarded by the global mutex
+
+	// NB! Circuit breaker state is guarded by the global mutex
+	failed    int       // Failed jobs in a row
+	openUntil time.Time // No jobs for the pod until then, when the breaker is open
+	probing   bool      // The probe job of half-open breaker is in flight
+}
+
+// load returns in-flight jobs per unit of capacity
+func (pod *Pod) load() float64 {
+	return float64(pod.inflight) / float64(pod.Weight)
+}
+
+var pods map[string]*Pod // all pods from the zoo by address
+
+func init() {
+	pods = make(map[string]*Pod)
+}
+
+// parsePod builds the pod from the zoo entry
+func parsePod(entry string) (*Pod, error) {
+	parts := strings.Split(strings.TrimSpace(entry), "|")
+	pod := &Pod{
+		Addr:     parts[0],
+		Protocol: "jobs",
+		Weight:   1,
+		healthy:  true,
+	}
+
+	if protocol, addr, found := strings.Cut(pod.Addr, "+"); found && !strings.Contains(protocol, "/") {
+		pod.Protocol = protocol
+		pod.Addr = addr
+	}
+	pod.Addr = strings.TrimSuffix(pod.Addr, "/")
+
+	if pod.Addr == "" {
+		return nil, fmt.Errorf("empty pod address")
+	}
+	addr, err := url.Parse(pod.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("wrong pod address: %s", err.Error())
+	}
+	if addr.Scheme != "http" && addr.Scheme != "https" || addr.Host == "" {
+		return nil, fmt.Errorf("wrong pod address %q: should look like http://host:port", pod.Addr)
+	}
+
+	for _, option := range parts[1:] {
+		key, value, _ := strings.Cut(option, "=")
+		switch strings.TrimSpace(key) {
+		case "model":
+			pod.Model = strings.TrimSpace(value)
+		case "weight":
+			weight, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || weight < 1 {
+				return nil, fmt.Errorf("wrong weight %q for pod %s", value, pod.Addr)
+			}
+			pod.Weight = weight
+		default:
+			return nil, fmt.Errorf("unknown option %q for pod %s", key, pod.Addr)
+		}
+	}
+
+	switch pod.Protocol {
+	case "jobs":
+		pod.backend = newJobsBackend(pod.Addr)
+	case "openai":
+		pod.backend = newOpenAIBackend(pod.Addr, pod.Model)
+	default:
+		return nil, fmt.Errorf("unknown protocol %q for pod %s", pod.Protocol, pod.Addr)
+	}
+
+	return pod, nil
+}
+
+// parseZoo parses comma separated list of zoo entries, registering pods
+// and returning their addresses. Broken entries are logged and skipped
+func parseZoo(list string, registry map[string]*Pod) []string {
+	var addrs []string
+	for _, entry := range strings.Split(list, ",") {
+		pod, err := parsePod(entry)
+		if err != nil {
+			fmt.Printf("\n[ ERR ] Wrong zoo entry: %s", err.Error())
+			log.Errorw("[ ERR ] Wrong zoo entry", "entry", entry, "error", err.Error())
+			continue
+		}
+		registry[pod.Addr] = pod
+		addrs = append(addrs, pod.Addr)
+	}
+	return addrs
+}
+
+// loadZoo reads pods, balancers and output filters from settings and replaces the zoo.
+// Pods which were not changed keep their health, load and connections
+func loadZoo() {
+	registry := make(map[string]*Pod)
+	chat := parseZoo(os.Getenv("CHATZOO"), registry)
+	pro := parseZoo(os.Getenv("PROZOO"), registry)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for addr, pod := range registry {
+		if prev, found := pods[addr]; found && prev.Protocol == pod.Protocol && prev.Model == pod.Model {
+			prev.Weight = pod.Weight
+			registry[addr] = prev
+		}
+	}
+
+	pods = registry
+	chatZoo = chat
+	proZoo = pro
+	zoo["chat"] = chatZoo
+	zoo["pro"] = proZoo
+
+	strategies["chat"] = os.Getenv("CHATBALANCER")
+	strategies["pro"] = os.Getenv("PROBALANCER")
+
+	loadFilters()
+}
+
+// reloadZoo re-reads .env and rebuilds the zoo without restart,
+// users sticked to removed pods are moved to others with their history
+func reloadZoo() {
+	fmt.Print("\n[ RELOAD ] Reloading the zoo...")
+	log.Info("[ RELOAD ] Reloading the zoo...")
+
+	if err := godotenv.Overload(); err != nil {
+		fmt.Printf("\n[ ERR ] Cant load .env file: %s", err.Error())
+		log.Errorw("[ ERR ] Cant load .env file, keep the zoo as is", "error", err.Error())
+		return
+	}
+
+	report := validateConfig()
+	report.Print()
+	if report.Fatal() {
+		log.Errorw("[ ERR ] Wrong settings, keep the zoo as is")
+		return
+	}
+
+	loadZoo()
+
+	var orphans []*User
+	mu.Lock()
+	for _, user := range users.List() {
+		if !contains(zoo[user.Mode], user.Server) {
+			orphans = append(orphans, user)
+		}
+	}
+	mu.Unlock()
+
+	for _, user := range orphans {
+		failover(user)
+	}
+
+	mu.Lock()
+	fmt.Printf("\n[ RELOAD ] Zoo was reloaded: %d pods, %d users moved", len(pods), len(orphans))
+	log.Infow("[ RELOAD ] Zoo was reloaded", "chat", chatZoo, "pro", proZoo, "moved", len(orphans))
+	mu.Unlock()
+}
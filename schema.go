@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// userSchema is the current version of user records persisted into DB
+const userSchema = 2
+
+// migrations upgrade raw user records step by step, the migration #N turns version N into N+1
+var migrations = []func(record map[string]any) error{
+
+	// 0 => 1: records before versioning, the processing status should never be persisted
+	func(record map[string]any) error {
+		delete(record, "status")
+		return nil
+	},
+
+	// 1 => 2: lifecycle metadata and counters. NB! Nothing to change in older records: the creation date is unknown,
+	// so it's left empty, and missing counters and mode stats mean zero usage, which is right for them
+	func(record map[string]any) error {
+		return nil
+	},
+}
+
+// decodeUser parses the user record of any known version, upgrading it to the current one
+func decodeUser(line []byte) (*User, error) {
+	record := make(map[string]any)
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber() // NB! Keep big Telegram IDs as is
+	if err := decoder.Decode(&record); err != nil {
+		return nil, err
+	}
+
+	version := 0
+	if raw, found := record["version"]; found {
+		number, ok := raw.(json.Number)
+		if !ok {
+			return nil, errors.New("wrong schema version")
+		}
+		v, err := number.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("wrong schema version: %s", err.Error())
+		}
+		version = int(v)
+	}
+
+	if version > userSchema {
+		return nil, fmt.Errorf("schema version %d is newer than supported %d", version, userSchema)
+	}
+
+	for ; version < userSchema; version++ {
+		if err := migrations[version](record); err != nil {
+			return nil, fmt.Errorf("migration from version %d failed: %s", version, err.Error())
+		}
+	}
+	record["version"] = userSchema
+
+	upgraded, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &User{}
+	if err := json.Unmarshal(upgraded, user); err != nil {
+		return nil, err
+	}
+	if user.TGID == 0 {
+		return nil, errors.New("there no Telegram ID")
+	}
+
+	return user, nil
+}
+
+// encodeUser serializes the user with the current schema version.
+// NB! Should be called under the global mutex
+func encodeUser(user *User) ([]byte, error) {
+	user.Version = userSchema
+	return json.Marshal(user)
+}
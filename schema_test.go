@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestDecodeUser(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    User
+		wantErr bool
+	}{
+		{
+			name: "before versioning",
+			line: `{"tgid":42,"username":"mira","mode":"chat","status":"processing","server":"http://pod"}`,
+			want: User{Version: userSchema, TGID: 42, Username: "mira", Mode: "chat", Server: "http://pod"},
+		},
+		{
+			name: "version 1",
+			line: `{"version":1,"tgid":42,"mode":"pro","session":"s1"}`,
+			want: User{Version: userSchema, TGID: 42, Mode: "pro", SessionID: "s1"},
+		},
+		{
+			name: "current version",
+			line: `{"version":2,"tgid":42,"created":"2024-01-02T03:04:05Z","messages":7,"chars":100,"modes":{"chat":7}}`,
+			want: User{Version: userSchema, TGID: 42, Created: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+				Messages: 7, OutputChars: 100, ModeStats: map[string]int{"chat": 7}},
+		},
+		{
+			name: "big Telegram ID",
+			line: `{"version":1,"tgid":9007199254740993}`,
+			want: User{Version: userSchema, TGID: 9007199254740993},
+		},
+		{name: "newer version", line: `{"version":3,"tgid":42}`, wantErr: true},
+		{name: "wrong version", line: `{"version":"1","tgid":42}`, wantErr: true},
+		{name: "no Telegram ID", line: `{"version":1,"username":"mira"}`, wantErr: true},
+		{name: "broken JSON", line: `{"version":1,"tgid":`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user, err := decodeUser([]byte(test.line))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got user %+v", user)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if got, want := mustEncode(t, user), mustEncode(t, &test.want); !bytes.Equal(got, want) {
+				t.Errorf("got %s\nwant %s", got, want)
+			}
+		})
+	}
+}
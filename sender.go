@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// Telegram limits for bots: about 30 messages per second overall and one message per second within the chat
+const (
+	globalInterval = time.Second / 30
+	chatInterval   = time.Second
+	typingInterval = 4 * time.Second // TG shows the chat action for 5 seconds
+)
+
+// Sender is the central outbound queue for all messages and edits sent to Telegram.
+// It paces requests within limits, waits as long as Telegram asks with 429 errors,
+// and coalesces pending edits of the same message, so only the latest text is sent.
+// Formatted messages rejected by Telegram are sent again as the plain text
+type Sender struct {
+	bot *tele.Bot
+
+	mu     sync.Mutex
+	queue  []*outgoing
+	edits  map[string]*outgoing // Pending edits by message
+	busy   map[string]bool      // Chats with the request in progress
+	next   map[string]time.Time // The time when the chat might get the next request
+	global time.Time            // The time when the next request might be sent at all
+	flood  time.Time            // The time until TG asked to wait with 429
+	wake   chan struct{}
+}
+
+// outgoing is the request waiting within the queue
+type outgoing struct {
+	chat string
+	to   tele.Recipient // for new messages
+	msg  tele.Editable  // for edits
+	key  string         // coalescing key of the edit
+	what any
+	opts []any
+
+	done chan result // nil when nobody waits for the result
+}
+
+type result struct {
+	msg *tele.Message
+	err error
+}
+
+var sender *Sender
+
+func newSender(bot *tele.Bot) *Sender {
+	sender := &Sender{
+		bot:   bot,
+		edits: make(map[string]*outgoing),
+		busy:  make(map[string]bool),
+		next:  make(map[string]time.Time),
+		wake:  make(chan struct{}, 1),
+	}
+	go sender.run()
+	return sender
+}
+
+// Send queues the new message and waits until it's sent
+func (sender *Sender) Send(to tele.Recipient, what any, opts ...any) (*tele.Message, error) {
+	out := &outgoing{chat: to.Recipient(), to: to, what: what, opts: opts, done: make(chan result, 1)}
+	sender.push(out)
+	res := <-out.done
+	return res.msg, res.err
+}
+
+// Edit queues the edit of the message and waits until it's sent or superseded by the later edit
+func (sender *Sender) Edit(msg tele.Editable, what any, opts ...any) (*tele.Message, error) {
+	out := newEdit(msg, what, opts)
+	out.done = make(chan result, 1)
+	sender.push(out)
+	res := <-out.done
+	return res.msg, res.err
+}
+
+// Update queues the edit of the message without waiting, it's handy for the progress of streamed output
+func (sender *Sender) Update(msg tele.Editable, what any, opts ...any) {
+	sender.push(newEdit(msg, what, opts))
+}
+
+func newEdit(msg tele.Editable, what any, opts []any) *outgoing {
+	messageID, chatID := msg.MessageSig()
+	chat := strconv.FormatInt(chatID, 10)
+	return &outgoing{chat: chat, msg: msg, key: chat + ":" + messageID, what: what, opts: opts}
+}
+
+// push adds the request to the queue, replacing the pending edit of the same message if any
+func (sender *Sender) push(out *outgoing) {
+	sender.mu.Lock()
+	if out.key != "" {
+		if pending, found := sender.edits[out.key]; found {
+			if pending.done != nil {
+				pending.done <- result{} // superseded
+			}
+			pending.what = out.what
+			pending.opts = out.opts
+			pending.done = out.done
+			sender.mu.Unlock()
+			return
+		}
+		sender.edits[out.key] = out
+	}
+	sender.queue = append(sender.queue, out)
+	sender.mu.Unlock()
+
+	sender.signal()
+}
+
+func (sender *Sender) signal() {
+	select {
+	case sender.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run dispatches requests as soon as limits allow, keeping the order within each chat
+func (sender *Sender) run() {
+	for {
+		out, wait := sender.pick()
+		if out == nil {
+			timer := time.NewTimer(wait)
+			select {
+			case <-sender.wake:
+			case <-timer.C:
+			}
+			timer.Stop()
+			continue
+		}
+		go sender.do(out)
+	}
+}
+
+// pick returns the first request allowed to be sent right now, or how long to wait otherwise
+func (sender *Sender) pick() (*outgoing, time.Duration) {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+
+	now := time.Now()
+	wait := time.Minute
+	if now.Before(sender.global) {
+		return nil, sender.global.Sub(now)
+	}
+
+	blocked := make(map[string]bool)
+	for i, out := range sender.queue {
+		if blocked[out.chat] {
+			continue
+		}
+		blocked[out.chat] = true // NB! Only the first request of each chat might go
+
+		if sender.busy[out.chat] {
+			continue
+		}
+		if next := sender.next[out.chat]; now.Before(next) {
+			if next.Sub(now) < wait {
+				wait = next.Sub(now)
+			}
+			continue
+		}
+
+		sender.queue = append(sender.queue[:i], sender.queue[i+1:]...)
+		if out.key != "" {
+			delete(sender.edits, out.key)
+		}
+		sender.busy[out.chat] = true
+		sender.global = now.Add(globalInterval)
+		return out, 0
+	}
+
+	return nil, wait
+}
+
+// do sends the request, putting it back into the queue when Telegram asks to wait
+func (sender *Sender) do(out *outgoing) {
+	res := sender.send(out, out.what, out.opts)
+
+	// -- TG rejects the markup it can't parse, so the message is sent again as the plain text
+	if text, found := out.what.(string); found && res.err != nil && strings.Contains(res.err.Error(), "can't parse entities") {
+		var opts []any
+		markup := false
+		for _, opt := range out.opts {
+			switch opt.(type) {
+			case tele.ParseMode:
+				text = plainText(text)
+				markup = true
+			case tele.Entities:
+				markup = true
+			default:
+				opts = append(opts, opt)
+			}
+		}
+		if markup {
+			log.Errorw("[ ERR ] Markup was rejected, fallback to the plain text", "chat", out.chat, "error", res.err.Error())
+			res = sender.send(out, text, opts)
+		}
+	}
+
+	var flood tele.FloodError
+	retry := errors.As(res.err, &flood)
+
+	sender.mu.Lock()
+	delete(sender.busy, out.chat)
+	sender.next[out.chat] = time.Now().Add(chatInterval)
+	if retry {
+		sender.hold(out.chat, flood.RetryAfter)
+
+		// -- put it back in front of the chat, unless there the newer edit of the same message
+		if _, found := sender.edits[out.key]; out.key != "" && found {
+			if out.done != nil {
+				out.done <- result{} // superseded
+			}
+		} else {
+			if out.key != "" {
+				sender.edits[out.key] = out
+			}
+			sender.queue = append([]*outgoing{out}, sender.queue...)
+		}
+	}
+	sender.mu.Unlock()
+
+	if !retry {
+		if res.err != nil && out.done == nil {
+			log.Errorw("[ ERR ] Problem editing message", "chat", out.chat, "error", res.err.Error())
+		}
+		if out.done != nil {
+			out.done <- res
+		}
+	}
+
+	sender.signal()
+}
+
+// Typing shows the chat action until the context is done. NB! Actions are not queued, as they are not messages,
+// but they count against TG limits too, so they take their slot and are skipped while TG asks to wait
+func (sender *Sender) Typing(ctx context.Context, to tele.Recipient) {
+	for {
+		if sender.action() {
+			err := sender.bot.Notify(to, tele.Typing)
+			var flood tele.FloodError
+			if errors.As(err, &flood) {
+				sender.mu.Lock()
+				sender.hold(to.Recipient(), flood.RetryAfter)
+				sender.mu.Unlock()
+			} else if err != nil {
+				log.Errorw("[ ERR ] Problem sending chat action", "chat", to.Recipient(), "error", err.Error())
+			}
+		}
+		if err := sleep(ctx, typingInterval); err != nil {
+			return
+		}
+	}
+}
+
+// action takes the slot for the chat action, unless TG asked to wait
+func (sender *Sender) action() bool {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(sender.flood) {
+		return false
+	}
+	if sender.global.Before(now) {
+		sender.global = now
+	}
+	sender.global = sender.global.Add(globalInterval)
+	return true
+}
+
+// hold stops sending to the chat as long as TG asked with 429. NB! It should be called under the lock
+func (sender *Sender) hold(chat string, retryAfter int) {
+	fmt.Printf("\n[ TG ] Too many requests, retry after %d sec", retryAfter)
+	log.Infow("[ TG ] Too many requests", "chat", chat, "retry", retryAfter)
+	deadline := time.Now().Add(time.Duration(retryAfter) * time.Second)
+	sender.next[chat] = deadline
+	// NB! TG might limit the bot as a whole, so nothing is sent to other chats till then too
+	if deadline.After(sender.global) {
+		sender.global = deadline
+	}
+	if deadline.After(sender.flood) {
+		sender.flood = deadline
+	}
+}
+
+// send makes the request to TG right away
+func (sender *Sender) send(out *outgoing, what any, opts []any) result {
+	var res result
+	if out.msg != nil {
+		res.msg, res.err = sender.bot.Edit(out.msg, what, opts...)
+		if errors.Is(res.err, tele.ErrSameMessageContent) {
+			res.err = nil
+		}
+	} else {
+		res.msg, res.err = sender.bot.Send(out.to, what, opts...)
+	}
+	return res
+}
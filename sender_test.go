@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// Pending edits of the same message are coalesced, so only the latest text is sent
+func TestSenderCoalescing(t *testing.T) {
+	tg, bot := newFakeTelegram(t)
+	sender := newSender(bot)
+
+	msg, err := sender.Send(&tele.User{ID: 1}, "first")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	// NB! The chat is paced, so all these edits are waiting within the queue
+	sender.Update(msg, "a")
+	sender.Update(msg, "b")
+	sender.Update(msg, "c")
+	if _, err := sender.Edit(msg, "last"); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	calls := tg.sent()
+	if len(calls) != 2 || calls[1].method != "editMessageText" || calls[1].text != "last" {
+		t.Fatalf("got calls %+v, want the message and the single edit", calls)
+	}
+	if gap := calls[1].at.Sub(calls[0].at); gap < chatInterval-50*time.Millisecond {
+		t.Errorf("the edit was sent only %v after the message", gap)
+	}
+}
+
+// The request rejected with 429 is sent again after retry_after, and other chats wait too
+func TestSenderFlood(t *testing.T) {
+	tg, bot := newFakeTelegram(t)
+	sender := newSender(bot)
+	tg.floods = 1
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := sender.Send(&tele.User{ID: 1}, "flooded")
+		done <- err
+	}()
+
+	// -- wait for the 429 answer
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tg.sent()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := sender.Send(&tele.User{ID: 2}, "other chat"); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("the flooded message is not sent: %s", err.Error())
+	}
+
+	calls := tg.sent()
+	if len(calls) != 3 || calls[0].method != "sendMessage:429" {
+		t.Fatalf("got calls %+v, want 429 and two messages", calls)
+	}
+	for _, call := range calls[1:] {
+		if gap := call.at.Sub(calls[0].at); gap < time.Second-50*time.Millisecond {
+			t.Errorf("message to chat %s was sent only %v after 429", call.chat, gap)
+		}
+	}
+}
+
+// Chat actions are skipped while TG asks to wait, as they count against the same limits
+func TestSenderTyping(t *testing.T) {
+	tg, bot := newFakeTelegram(t)
+	sender := newSender(bot)
+	tg.floods = 1
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	sender.Typing(ctx, &tele.User{ID: 1}) // gets 429
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	sender.Typing(ctx, &tele.User{ID: 2}) // should be skipped
+
+	if _, err := sender.Send(&tele.User{ID: 2}, "message"); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	tg.mu.Lock()
+	calls := tg.calls
+	tg.mu.Unlock()
+	if len(calls) != 2 || calls[0].method != "sendChatAction:429" || calls[1].method != "sendMessage" {
+		t.Fatalf("got calls %+v, want 429 and the message", calls)
+	}
+	if gap := calls[1].at.Sub(calls[0].at); gap < time.Second-50*time.Millisecond {
+		t.Errorf("the message was sent only %v after 429", gap)
+	}
+}
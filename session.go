@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// maxHistory limits how many messages are sent to pods as the context,
+// sessions keep only the turns which fit into it
+const maxHistory = 32
+
+// Message is the single turn of the dialog in the format understood by most inference servers
+type Message struct {
+	Role    string `json:"role"` // user / assistant
+	Content string `json:"content"`
+}
+
+// getSession returns the current session of the user, creating it if needed
+func getSession(user *User) *Session {
+	mu.Lock()
+	sessionID := user.SessionID
+	mu.Unlock()
+
+	return findSession(user, sessionID)
+}
+
+// findSession returns the session of the user with given ID, creating it if needed
+func findSession(user *User, sessionID string) *Session {
+	mu.Lock()
+	defer mu.Unlock()
+
+	session, found := sessions[sessionID]
+	if !found {
+		session = &Session{
+			UserID:    user.ID,
+			TGID:      strconv.FormatInt(user.TGID, 10),
+			SessionID: sessionID,
+		}
+		sessions[sessionID] = session
+	}
+
+	return session
+}
+
+// history returns the last messages of the session, limited to maxHistory
+func history(sessionID string) []*Message {
+	mu.Lock()
+	defer mu.Unlock()
+
+	session, found := sessions[sessionID]
+	if !found {
+		return nil
+	}
+
+	var messages []*Message
+	for i, prompt := range session.Prompts {
+		messages = append(messages, &Message{Role: "user", Content: prompt})
+		if i < len(session.Outputs) {
+			messages = append(messages, &Message{Role: "assistant", Content: session.Outputs[i]})
+		}
+	}
+	if len(messages) > maxHistory {
+		messages = messages[len(messages)-maxHistory:]
+	}
+
+	return messages
+}
+
+// replay returns the history to restore the context on the pod which does not know the session yet
+func (session *Session) replay(server string) []*Message {
+	mu.Lock()
+	known := session.Server == server
+	mu.Unlock()
+
+	if known {
+		return nil
+	}
+	return history(session.SessionID)
+}
+
+// record remembers the turn of the dialog and the pod which knows the context now.
+// NB! The history is locked first, so compaction never writes the turn which is appended right after it
+func (session *Session) record(prompt, output, server string) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	mu.Lock()
+	session.Prompts = append(session.Prompts, prompt)
+	session.Outputs = append(session.Outputs, output)
+	session.Server = server
+	session.trim()
+	mu.Unlock()
+
+	writeHistory(&HistoryRecord{
+		Session: session.SessionID,
+		TGID:    session.TGID,
+		Prompt:  prompt,
+		Output:  output,
+		Server:  server,
+	})
+}
+
+// trim drops the oldest turns which are never sent to pods anyway.
+// NB! Should be called under the global mutex
+func (session *Session) trim() {
+	if extra := len(session.Prompts) - maxHistory/2; extra > 0 {
+		session.Prompts = append([]string{}, session.Prompts[extra:]...)
+		if extra > len(session.Outputs) {
+			extra = len(session.Outputs)
+		}
+		session.Outputs = append([]string{}, session.Outputs[extra:]...)
+	}
+}
+
+// failover moves the user onto another healthy pod of the same mode. The new session inherits
+// the history of the old one, so it's replayed to the new pod with the next job
+func failover(user *User, exclude ...string) bool {
+	server := pickPod(user.Mode, append(exclude, user.Server)...)
+	if server == "" || server == user.Server || contains(exclude, server) {
+		return false
+	}
+
+	mu.Lock()
+
+	sessionID := uuid.New().String()
+	session := &Session{
+		UserID:    user.ID,
+		TGID:      strconv.FormatInt(user.TGID, 10),
+		SessionID: sessionID,
+	}
+	if prev, found := sessions[user.SessionID]; found {
+		session.Prompts = append([]string{}, prev.Prompts...)
+		session.Outputs = append([]string{}, prev.Outputs...)
+	}
+	sessions[sessionID] = session
+
+	fmt.Printf("\n[ POD ] Failover from %s to %s", user.Server, server)
+	log.Infow("[ POD ] Failover to another pod", "user", user.TGID, "from", user.Server, "to", server,
+		"session", sessionID, "history", len(session.Prompts))
+
+	parent := user.SessionID
+	user.Server = server
+	user.SessionID = sessionID
+	mu.Unlock()
+
+	users.Put(user)
+
+	appendHistory(&HistoryRecord{
+		Session: sessionID,
+		Parent:  parent,
+		TGID:    session.TGID,
+	})
+
+	return true
+}
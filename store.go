@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// UserStore keeps all users of the bot by their Telegram ID.
+// NB! Users are shared by pointer, so Put should be called after changing persisted fields
+type UserStore interface {
+	Get(tgid int64) (*User, bool)
+	Put(user *User) error
+	List() []*User
+	Delete(tgid int64) error
+}
+
+// -- MemoryStore
+
+// MemoryStore keeps users in memory only, it's handy for tests and as the base for other stores
+type MemoryStore struct {
+	mu    sync.RWMutex
+	users map[int64]*User
+}
+
+func newMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users: make(map[int64]*User),
+	}
+}
+
+func (store *MemoryStore) Get(tgid int64) (*User, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	user, found := store.users[tgid]
+	return user, found
+}
+
+func (store *MemoryStore) Put(user *User) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.users[user.TGID] = user
+	return nil
+}
+
+func (store *MemoryStore) List() []*User {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	list := make([]*User, 0, len(store.users))
+	for _, user := range store.users {
+		list = append(list, user)
+	}
+	return list
+}
+
+func (store *MemoryStore) Delete(tgid int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.users, tgid)
+	return nil
+}
+
+// -- FileStore
+
+// FileStore serves users from memory and dumps them into the file as JSON lines.
+// Every change between snapshots is recorded into the journal
+type FileStore struct {
+	*MemoryStore
+	Path string
+
+	journal *Journal
+	saveMu  sync.Mutex // NB! Snapshots might be saved by timer and on shutdown at the same time
+}
+
+func newFileStore(path, journalPath string) *FileStore {
+	return &FileStore{
+		MemoryStore: newMemoryStore(),
+		Path:        path,
+		journal:     newJournal(journalPath),
+	}
+}
+
+func (store *FileStore) Put(user *User) error {
+	store.MemoryStore.Put(user)
+	return store.journal.record(user)
+}
+
+func (store *FileStore) Delete(tgid int64) error {
+	store.MemoryStore.Delete(tgid)
+	return store.journal.forget(tgid)
+}
+
+// Close saves the last snapshot and flushes the journal
+func (store *FileStore) Close() error {
+	err := store.Save()
+	store.journal.close()
+	return err
+}
+
+// Load reads all users from the last snapshot and replays the journal on top of it.
+// Broken lines are skipped. When there no snapshot, the backup is used, as the crash might happen between renames
+func (store *FileStore) Load() error {
+	if err := store.load(); err != nil {
+		return err
+	}
+	return store.journal.replay(store.MemoryStore)
+}
+
+func (store *FileStore) load() error {
+	db, err := os.OpenFile(store.Path, os.O_RDONLY, 0644)
+	if os.IsNotExist(err) {
+		db, err = os.OpenFile(store.Path+".bak", os.O_RDONLY, 0644)
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// NB! Records which can't be loaded are kept aside, otherwise the next snapshot drops them forever
+	var rejected []byte
+
+	scanner := bufio.NewScanner(db)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		user, err := decodeUser(line)
+		if err != nil {
+			fmt.Printf("\n[ ERR ] Can't load user record: %s", err.Error())
+			log.Errorw("[ ERR ] Can't load user record", "error", err.Error(), "record", string(line))
+			rejected = append(append(rejected, line...), '\n')
+			continue
+		}
+		store.MemoryStore.Put(user)
+	}
+
+	if len(rejected) > 0 {
+		if err := appendFile(store.Path+".rejected", rejected); err != nil {
+			log.Errorw("[ ERR ] Can't save rejected user records", "error", err.Error())
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Save dumps all users into the temp file and atomically replaces the older one with it,
+// keeping the previous version as .bak, so the crash in the middle never leaves broken DB.
+// The journal is rotated then, as all events before the snapshot are not needed anymore
+func (store *FileStore) Save() error {
+	store.saveMu.Lock()
+	defer store.saveMu.Unlock()
+
+	mark := store.journal.mark()
+
+	tmp := store.Path + ".tmp"
+	db, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(db)
+	mu.Lock() // NB! User fields are guarded by the global mutex
+	for _, user := range store.List() {
+		userJSON, err := encodeUser(user)
+		if err != nil {
+			log.Errorw("[ ERR ] Can't marshal user", "user", user.TGID, "error", err.Error())
+			continue
+		}
+		writer.Write(userJSON)
+		writer.WriteByte('\n')
+	}
+	mu.Unlock()
+
+	err = writer.Flush()
+	if err == nil {
+		err = db.Sync()
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// -- rotate the backup, the missing older file is fine for the very first snapshot
+	if err := os.Rename(store.Path, store.Path+".bak"); err != nil && !os.IsNotExist(err) {
+		log.Errorw("[ ERR ] Can't backup users DB file", "error", err.Error())
+	}
+
+	if err := os.Rename(tmp, store.Path); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(store.Path)); err != nil {
+		return err
+	}
+
+	if err := store.journal.rotate(mark); err != nil {
+		log.Errorw("[ ERR ] Can't rotate journal", "error", err.Error())
+	}
+	return nil
+}
+
+// Snapshot saves users at given interval in background, so the crash loses only the last seconds
+func (store *FileStore) Snapshot(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			time.Sleep(interval)
+			if err := store.Save(); err != nil {
+				fmt.Printf("\n[ ERR ] Can't save users snapshot: %s", err.Error())
+				log.Errorw("[ ERR ] Can't save users snapshot", "error", err.Error())
+			}
+		}
+	}()
+}
+
+// appendFile adds data to the end of the file
+func appendFile(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// syncDir makes renames within the directory durable
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// -- User lifecycle
+
+// seen counts the new message of the user
+func (user *User) seen() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	user.LastSeen = time.Now()
+	user.Messages++
+	if user.ModeStats == nil {
+		user.ModeStats = make(map[string]int)
+	}
+	user.ModeStats[user.Mode]++
+}
+
+// answered counts characters of the answer sent to the user
+func (user *User) answered(output string) {
+	mu.Lock()
+	user.OutputChars += utf8.RuneCountInString(output)
+	mu.Unlock()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	log = zap.NewNop().Sugar()
+	os.Exit(m.Run())
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := newMemoryStore()
+	store.Put(&User{TGID: 1, Mode: "chat"})
+	store.Put(&User{TGID: 2, Mode: "pro"})
+	store.Put(&User{TGID: 1, Mode: "pro"})
+	store.Delete(2)
+	store.Delete(3)
+
+	if list := store.List(); len(list) != 1 {
+		t.Fatalf("got %d users, want 1", len(list))
+	}
+	if user, found := store.Get(1); !found || user.Mode != "pro" {
+		t.Errorf("got user %+v, found %v", user, found)
+	}
+	if _, found := store.Get(2); found {
+		t.Errorf("deleted user is found")
+	}
+}
+
+// Users should survive the snapshot
+func TestFileStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, journalPath := filepath.Join(dir, "telezoo.db"), filepath.Join(dir, "telezoo.journal")
+
+	store := newFileStore(dbPath, journalPath)
+	if err := store.Load(); err != nil {
+		t.Fatalf("can't load empty store: %s", err.Error())
+	}
+	want := []*User{
+		{TGID: 1, Username: "one", Mode: "chat", SessionID: "s1"},
+		{TGID: 2, Username: "two", Mode: "pro", Server: "http://pod"},
+	}
+	for _, user := range want {
+		store.Put(user)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("can't save snapshot: %s", err.Error())
+	}
+
+	restored := newFileStore(dbPath, journalPath)
+	if err := restored.Load(); err != nil {
+		t.Fatalf("can't load store: %s", err.Error())
+	}
+	defer restored.Close()
+
+	if list := restored.List(); len(list) != len(want) {
+		t.Fatalf("got %d users, want %d", len(list), len(want))
+	}
+	for _, user := range want {
+		got, found := restored.Get(user.TGID)
+		if !found {
+			t.Errorf("user %d is lost", user.TGID)
+			continue
+		}
+		if got, want := mustEncode(t, got), mustEncode(t, user); !bytes.Equal(got, want) {
+			t.Errorf("user %d:\n got %s\nwant %s", user.TGID, got, want)
+		}
+	}
+}
+
+func mustEncode(t *testing.T, user *User) []byte {
+	t.Helper()
+	mu.Lock()
+	defer mu.Unlock()
+	data, err := encodeUser(user)
+	if err != nil {
+		t.Fatalf("can't encode user: %s", err.Error())
+	}
+	return data
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data+"\n"), 0644); err != nil {
+		t.Fatalf("can't write %s: %s", path, err.Error())
+	}
+}
+
+// The crash between renames leaves the backup only, and broken records are kept aside instead of being lost
+func TestSnapshotRecovery(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, journalPath := filepath.Join(dir, "telezoo.db"), filepath.Join(dir, "telezoo.journal")
+
+	store := newFileStore(dbPath, journalPath)
+	store.Load()
+	store.Put(&User{TGID: 1, Mode: "chat"})
+	store.Save()
+	store.Put(&User{TGID: 2, Mode: "pro"})
+	store.Close()
+
+	if _, err := os.Stat(dbPath + ".bak"); err != nil {
+		t.Fatalf("there no backup: %s", err.Error())
+	}
+	if _, err := os.Stat(dbPath + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temp file is left")
+	}
+
+	// -- the backup keeps the previous snapshot
+	os.Remove(dbPath)
+	os.Remove(journalPath)
+	restored := newFileStore(dbPath, journalPath)
+	if err := restored.Load(); err != nil {
+		t.Fatalf("can't load store: %s", err.Error())
+	}
+	restored.Close()
+	if list := restored.List(); len(list) != 1 || list[0].TGID != 1 {
+		t.Errorf("got users %+v from the backup, want user 1", list)
+	}
+
+	// -- broken record
+	writeFile(t, dbPath, `{"version":2,"tgid":1}`+"\n"+`{"version":2,"tgid":`)
+	os.Remove(journalPath)
+	broken := newFileStore(dbPath, journalPath)
+	if err := broken.Load(); err != nil {
+		t.Fatalf("can't load store: %s", err.Error())
+	}
+	broken.Close()
+	if len(broken.List()) != 1 {
+		t.Errorf("got %d users, want 1", len(broken.List()))
+	}
+	rejected, err := os.ReadFile(dbPath + ".rejected")
+	if err != nil || !bytes.Contains(rejected, []byte(`{"version":2,"tgid":`)) {
+		t.Errorf("broken record is not kept aside: %q", rejected)
+	}
+}
+
+// Lifecycle counters should grow with messages and answers and survive the snapshot
+func TestUserLifecycle(t *testing.T) {
+	user := &User{TGID: 1, Mode: "chat"}
+	user.seen()
+	user.seen()
+	user.Mode = "pro"
+	user.seen()
+	user.answered("Привет!")
+
+	if user.Messages != 3 || user.OutputChars != 7 || user.LastSeen.IsZero() {
+		t.Errorf("got messages %d, chars %d, seen %v", user.Messages, user.OutputChars, user.LastSeen)
+	}
+	if user.ModeStats["chat"] != 2 || user.ModeStats["pro"] != 1 {
+		t.Errorf("got mode stats %v", user.ModeStats)
+	}
+
+	restored, err := decodeUser(mustEncode(t, user))
+	if err != nil {
+		t.Fatalf("can't decode user: %s", err.Error())
+	}
+	if got, want := mustEncode(t, restored), mustEncode(t, user); !bytes.Equal(got, want) {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"time"
+)
+
+// podStream is the open answer of the pod, which is consumed by Backend.Stream after Backend.Submit
+type podStream struct {
+	body        io.ReadCloser
+	contentType string
+	cancel      context.CancelFunc
+}
+
+// detach returns the context to start the stream which outlives the call, so it's cancelled
+// together with the parent only until connected is called [ exactly once ]
+func detach(ctx context.Context) (streamCtx context.Context, cancel context.CancelFunc, connected func()) {
+	streamCtx, cancel = context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-done:
+		}
+	}()
+	return streamCtx, cancel, func() { close(done) }
+}
+
+// isStream checks whether the pod answered with Server-Sent Events or chunked JSON lines
+func isStream(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/event-stream", "application/x-ndjson", "application/jsonl":
+		return true
+	}
+	return false
+}
+
+// readStream calls event for each data payload found within SSE or JSON lines stream
+func readStream(ctx context.Context, body io.ReadCloser, contentType string, event func(data []byte) error) error {
+
+	// -- break reading as soon as the caller gives up
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			body.Close()
+		case <-done:
+		}
+	}()
+
+	sse := false
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "text/event-stream" {
+		sse = true
+	}
+
+	var data []byte
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+
+		// -- JSON lines: each line is the whole event
+		if !sse {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			if err := event(line); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// -- SSE: data lines are joined until the empty line, other fields are ignored
+		if len(line) == 0 {
+			if len(data) > 0 {
+				if err := event(data); err != nil {
+					return err
+				}
+			}
+			data = nil
+			continue
+		}
+		if payload, found := bytes.CutPrefix(line, []byte("data:")); found {
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, bytes.TrimPrefix(payload, []byte(" "))...)
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// the last event might be not terminated with the empty line
+	if len(data) > 0 {
+		return event(data)
+	}
+
+	return nil
+}
+
+// reporter throttles output updates, so streaming pods do not flood TG with edits
+type reporter struct {
+	update func(output string) error
+	last   time.Time
+	output string
+}
+
+// report passes the output further if it was changed and enough time passed since the last update,
+// force is used for the final output and for backends with their own cadence
+func (r *reporter) report(output string, force bool) error {
+	if output == r.output || !force && time.Since(r.last) < updateInterval {
+		return nil
+	}
+	r.last = time.Now()
+	r.output = output
+	return r.update(output)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadStream(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        []string
+	}{
+		{
+			name:        "SSE events",
+			contentType: "text/event-stream",
+			body:        "data: one\n\ndata: two\n\n",
+			want:        []string{"one", "two"},
+		},
+		{
+			name:        "SSE multiline data and other fields",
+			contentType: "text/event-stream; charset=utf-8",
+			body:        "event: token\nid: 1\ndata: first\ndata:second\n\n: comment\n\n",
+			want:        []string{"first\nsecond"},
+		},
+		{
+			name:        "SSE last event without the empty line",
+			contentType: "text/event-stream",
+			body:        "data: one\n\ndata: two",
+			want:        []string{"one", "two"},
+		},
+		{
+			name:        "JSON lines",
+			contentType: "application/x-ndjson",
+			body:        "{\"token\":\"a\"}\n\n{\"token\":\"b\"}\n",
+			want:        []string{`{"token":"a"}`, `{"token":"b"}`},
+		},
+		{
+			name:        "empty stream",
+			contentType: "text/event-stream",
+			body:        "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			body := io.NopCloser(strings.NewReader(test.body))
+			err := readStream(context.Background(), body, test.contentType, func(data []byte) error {
+				got = append(got, string(data))
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// Pods which only stream might never send the final status and know nothing about polling
+func TestJobsBackendStream(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		output string
+	}{
+		{"finished", "{\"token\":\"Hello\"}\n{\"token\":\" world\",\"status\":\"finished\"}\n", "Hello world"},
+		{"without status", "{\"token\":\"Hello\"}\n{\"token\":\" world\"}\n", "Hello world"},
+		{"whole output", "{\"output\":\"Hel\"}\n{\"output\":\"Hello\"}\n", "Hello"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			polled := false
+			pod := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost {
+					polled = true
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.Header().Set("Content-Type", "application/x-ndjson")
+				io.WriteString(w, test.stream)
+			}))
+			defer pod.Close()
+
+			backend := newJobsBackend(pod.URL)
+			job := &Job{ID: "job", Prompt: "Hi"}
+			if err := backend.Submit(context.Background(), job); err != nil {
+				t.Fatalf("unexpected submit error: %s", err.Error())
+			}
+			if err := backend.Stream(context.Background(), job, func(string) error { return nil }); err != nil {
+				t.Fatalf("unexpected stream error: %s", err.Error())
+			}
+			if job.Output != test.output || job.Status != "finished" {
+				t.Errorf("got output %q with status %q, want %q", job.Output, job.Status, test.output)
+			}
+			if polled {
+				t.Errorf("the pod was polled after the stream")
+			}
+		})
+	}
+}
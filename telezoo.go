@@ -1,16 +1,11 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"math/rand"
-	"net/http"
 	"os"
 	"os/signal"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -24,18 +19,25 @@ import (
 
 const VERSION = "0.32.0"
 
-// [ ] TODO: Verify .etc hosts agains regexp
-// [ ] TODO: USER => Store creation date
+const (
+	submitAttempts = 3  // How many pods to try before giving up with the new job
+	historyShown   = 16 // How many messages to show with /history command
+)
+
+var errTelegram = errors.New("problem with telegram")
+
+// [*] TODO: Verify .etc hosts agains regexp
+// [*] TODO: USER => Store creation date
 // [ ] TODO: Do not save empty users and duplicates into users.db
 // [*] FIXME: fastHTTP.Do... => json.Unmarshal... => ERROR = invalid character 'R' looking for beginning of value | BODY = Requested ID was not found!
 // [*] FIXME: ^^^ fastHTTP.Do... => json.Unmarshal... => ERROR = invalid character 'R' looking for beginning of value
-// [ ] FIXME: Adapt TG version of Markdown for different models
-// [ ] FIXME: If the .env was changed and there no more the host, that was sticked to the user or session, dump the older host!
-// [ ] TODO: Detect wrong hosts on start? [ ERR ] HTTP POST: could not create request: parse "http://209.137.198.8 :15415/jobs": invalid character " " in host name
+// [*] FIXME: Adapt TG version of Markdown for different models
+// [*] FIXME: If the .env was changed and there no more the host, that was sticked to the user or session, dump the older host!
+// [*] TODO: Detect wrong hosts on start? [ ERR ] HTTP POST: could not create request: parse "http://209.137.198.8 :15415/jobs": invalid character " " in host name
 // [ ] FIXME: Inspect on start - are there another instance still running?
 // [ ] TODO: daemond
 // [*] TODO: Save user IDs into disk storage, SQLite vs json.Marshal?
-// [ ] TODO: Send an empty message (rotated icon???) even before trying to call GPU?
+// [*] TODO: Send an empty message (rotated icon???) even before trying to call GPU?
 // [ ] TODO: Paste eye catching picture inside Hello Message
 // [-] TODO: Find great 13B / 30B LLaMA model for CHAT mode
 // [*] TODO: Proper logging
@@ -61,14 +63,21 @@ var (
 )
 
 type Job struct {
-	ID      string `json:"id"`
-	Prompt  string `json:"prompt"`
-	Session string `json:"session"`
-	Output  string `json:"output,omitempty"`
-	Status  string `json:"status,omitempty"`
+	ID       string `json:"id"`
+	Prompt   string `json:"prompt"`
+	Session  string `json:"session"`
+	Output   string `json:"output,omitempty"`
+	Status   string `json:"status,omitempty"`
+	Callback string `json:"callback,omitempty"` // URL for pods to push the progress
+
+	// Pods should push the progress with Authorization: Bearer <token> header
+	CallbackToken string `json:"callback_token,omitempty"`
+
+	History []*Message `json:"history,omitempty"` // Previous turns to restore the context on the pod, which lost the session
 }
 
 type User struct {
+	Version   int    `json:"version"`      // Schema version of persisted record
 	ID        string `json:"id,omitempty"` // User ID within external system
 	Username  string `json:"username,omitempty"`
 	TGID      int64  `json:"tgid,omitempty"`    // User ID within Telegram
@@ -77,6 +86,18 @@ type User struct {
 	// NB! Do not serialize status into DB before server do not start right for users with "processing" tasks
 	Status string `json:"status,omitempty"` // processing status
 	Server string `json:"server,omitempty"` // Server address for sticky sessions
+
+	Flight *Flight `json:"flight,omitempty"` // The job in flight to resume after restart
+
+	// NB! Lifecycle metadata is persisted with snapshots only, zero creation date means unknown
+	Created     time.Time      `json:"created"`         // First message
+	LastSeen    time.Time      `json:"seen"`            // Last message
+	Messages    int            `json:"messages"`        // Total messages
+	OutputChars int            `json:"chars"`           // Total characters within answers
+	ModeStats   map[string]int `json:"modes,omitempty"` // Messages per mode
+
+	job  *Job               // the job in flight
+	stop context.CancelFunc // aborts the job in flight
 }
 
 type Session struct {
@@ -90,15 +111,17 @@ type Session struct {
 }
 
 var (
-	users    map[int64]*User
-	sessions map[string]string
+	users    UserStore
+	sessions map[string]*Session
 
 	helloMessage = "Привет! Я Мира. Похоже на первое знакомство :)\n\n" +
 		"Сразу поясню - я понимаю разные языки, в том числе русский и английский. " +
 		"Могу поддержать разговор на любую тему, просто пиши в чат.\n\n" +
 		//"Если потребуется что-то посерьезнее, переключи меня в режим PRO - ведь это бесплатно.\n\n" +
 		"Рекомендую запомнить эти команды:\n\n" +
-		"/new - начать новый диалог [ забыть историю ]\n"
+		"/new - начать новый диалог [ забыть историю ]\n" +
+		"/stop - остановить ответ [ если он затянулся ]\n" +
+		"/history - показать историю диалога\n"
 	// "/chat - пообщаться о жизни [ отвечает быстро ]\n" +
 	// "/pro - включить интеллект [ будет медленно ]\n"
 
@@ -114,8 +137,8 @@ var (
 )
 
 func init() {
-	users = make(map[int64]*User)
-	sessions = make(map[string]string)
+	users = newMemoryStore()
+	sessions = make(map[string]*Session)
 	zoo = make(map[string][]string)
 }
 
@@ -152,23 +175,69 @@ func main() {
 	fmt.Print("\n[ START ] TeleZoo v" + VERSION + " is starting...")
 	log.Info("[ START ] TeleZoo v" + VERSION + " is starting...")
 
+	// -- Validate settings and refuse to start with wrong ones
+
+	report := validateConfig()
+	report.Print()
+	if report.Fatal() {
+		fmt.Printf("\n[ ERROR ] Wrong settings, shutdown...\n\n")
+		log.Error("[ ERR ] Wrong settings, shutdown...")
+		logger.Sync()
+		os.Exit(0)
+	}
+
 	// -- Init GPU pods
 
-	chatZoo = strings.Split(os.Getenv("CHATZOO"), ",")
-	proZoo = strings.Split(os.Getenv("PROZOO"), ",")
-	zoo["chat"] = chatZoo
-	zoo["pro"] = proZoo
+	loadZoo()
+
+	breaker = newCircuitBreaker()
+
+	if mode := os.Getenv("FORMAT"); mode != "" {
+		formatMode = mode
+	}
+
+	// -- Watch for pods health
+
+	newHealthChecker().Start()
+
+	// -- Listen for pods pushing the job progress
+
+	if listen := os.Getenv("CALLBACK_LISTEN"); listen != "" {
+		callbacks = startCallbacks(listen, os.Getenv("CALLBACK_URL"), os.Getenv("CALLBACK_TOKEN"))
+		fmt.Printf("\n[ START ] Listening for pod callbacks on %s...", listen)
+		log.Infow("[ START ] Listening for pod callbacks", "listen", listen, "url", callbacks.URL)
+	}
+
+	// -- Open users DB
+
+	db := newFileStore("telezoo.db", "telezoo.journal")
+	if err := db.Load(); err != nil {
+		fmt.Printf("\n[ ERR ] Can't load users from DB file: %s", err.Error())
+		log.Errorw("[ ERR ] Can't load users from DB file", "error", err.Error())
+	}
+	users = db
+	db.Snapshot(time.Duration(envInt("SNAPSHOT_INTERVAL", 10)) * time.Second)
 
 	// --- Allow graceful shutdown via OS signals
 	// https://ieftimov.com/posts/four-steps-daemonize-your-golang-programs/
 
-	signalChan := make(chan os.Signal)
+	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan,
-		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
 
+	// --- Reload the zoo on SIGHUP without dropping users
+
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+
+	go func() {
+		for range reloadChan {
+			reloadZoo()
+		}
+	}()
+
 	// --- Listen for OS signals in background
 
 	go func() {
@@ -197,19 +266,11 @@ func main() {
 			//	log.Infof("[STOP] Wait while [ %d ] requests will be finished...", pending)
 			//}
 
-			// TODO: Backup an older file before rewrite?
-			db, err := os.OpenFile("telezoo.db", os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				log.Info("[ERR] Can't dump users to DB file")
-			} else {
-				for _, user := range users {
-					userJSON, _ := json.Marshal(*user)
-					//fmt.Printf("\n\nUSER JSON: %s", string(userJSON)) // DEBUG
-					db.WriteString(string(userJSON) + "\n")
-				}
-				db.Sync()
-				db.Close()
+			if err := db.Close(); err != nil {
+				log.Errorw("[ERR] Can't dump users to DB file", "error", err.Error())
 			}
+
+			closeHistory()
 		}
 
 		os.Exit(0)
@@ -219,6 +280,7 @@ func main() {
 
 	defer func() {
 		signal.Stop(signalChan)
+		signal.Stop(reloadChan)
 
 		reason := recover()
 		if reason != nil {
@@ -233,37 +295,32 @@ func main() {
 
 	// -- Load users from DB [ draft version using local file for faster development ]
 
-	db, err := os.OpenFile("telezoo.db", os.O_RDONLY, 0644)
-	scanner := bufio.NewScanner(db)
-
-	for scanner.Scan() {
-		userJSON := scanner.Text()
-		user := &User{}
-		err := json.Unmarshal([]byte(userJSON), &user)
-		if err != nil || user.TGID == 0 {
-			continue
-		}
-		// FIXME: Trying to reload status as is
-		user.Status = "" // reset the status, but maybe lose some messages were been processing
+	for _, user := range db.List() {
+		// NB! Jobs in flight are resumed after the bot is set up
+		user.Status = ""
 
 		// Respawn dead servers
 		if !isPodActive(user.Mode, user.Server) {
-			user.Server = randomPod(user.Mode)
+			user.Server = pickPod(user.Mode)
 			user.SessionID = uuid.New().String()
 			user.Status = ""
+			users.Put(user)
 		}
-
-		users[user.TGID] = user
 	}
 
-	db.Close()
+	// -- Load the history of all dialogs
+
+	if err := openHistory("telezoo.history"); err != nil {
+		fmt.Printf("\n[ ERR ] Can't open history file: %s", err.Error())
+		log.Errorw("[ ERR ] Can't open history file, the history will not be saved", "error", err.Error())
+	}
 
 	// -- Set up bot
 
 	pref := tele.Settings{
-		Token:     os.Getenv("TELEGRAM_TOKEN"),
-		Poller:    &tele.LongPoller{Timeout: 10 * time.Second},
-		ParseMode: "Markdown", // NB!
+		Token:  os.Getenv("TELEGRAM_TOKEN"),
+		Poller: &tele.LongPoller{Timeout: 10 * time.Second},
+		// NB! Parse mode is set per message, so rejected markup might fall back to the plain text
 	}
 
 	bot, err := tele.NewBot(pref)
@@ -281,13 +338,7 @@ func main() {
 		log.Infow("[ MSG ] New message", "user", tgUser.ID, "prompt", prompt)
 		fmt.Printf("\n[ MSG ] New message: %s", prompt)
 
-		// allow more time for important requests and less for those which might be ignored
-		slowHTTP := http.Client{Timeout: 10 * time.Second}
-		fastHTTP := http.Client{Timeout: 2 * time.Second}
-
-		mu.Lock()
-		user, found := users[tgUser.ID]
-		mu.Unlock()
+		user, found := users.Get(tgUser.ID)
 
 		// -- new user ?
 
@@ -299,17 +350,31 @@ func main() {
 				TGID:      tgUser.ID,
 				Username:  tgUser.Username,
 				Mode:      "chat",
-				Server:    randomPod("chat"),
+				Server:    pickPod("chat"),
 				SessionID: uuid.New().String(),
 				Status:    "",
+				Created:   time.Now(),
 			}
 
-			mu.Lock()
-			users[tgUser.ID] = user
-			mu.Unlock()
+			if err := users.Put(user); err != nil {
+				log.Errorw("[ ERR ] Problem saving user", "user", tgUser.ID, "error", err.Error())
+			}
 
 			// send hello message with instructions
-			bot.Send(tgUser, helloMessage) // TODO: Handle errors
+			sender.Send(tgUser, helloMessage) // TODO: Handle errors
+		}
+
+		user.seen()
+
+		// -- show the user the answer is coming while the job is queued or running
+
+		typingCtx, stopTyping := context.WithCancel(context.Background())
+		defer stopTyping()
+		go sender.Typing(typingCtx, tgUser)
+
+		answer := newAnswer(tgUser, nil)
+		if err := answer.Placeholder(); err != nil {
+			log.Errorw("[ ERR ] Problem sending placeholder", "user", tgUser.ID, "error", err.Error())
 		}
 
 		// catch processing GPU slot for the current request
@@ -318,12 +383,14 @@ func main() {
 		// TODO: wathcdog / deadline to break deadlocks
 
 		allowProcessing := false
+		renewed := false
 		for {
 			mu.Lock()
 			if user.Status != "processing" {
 				user.Status = "processing"
 				if user.SessionID == "" {
 					user.SessionID = uuid.New().String()
+					renewed = true
 				}
 				allowProcessing = true
 			}
@@ -334,264 +401,179 @@ func main() {
 			fmt.Printf(" [ WAIT-FOR-GPU-SLOT ] ") // DEBUG
 			time.Sleep(300 * time.Millisecond)
 		}
+		if renewed {
+			users.Put(user)
+		}
+
+		// -- move the user to the healthy pod if the sticky one is dead, the history will be replayed there
+
+		if !isPodHealthy(user.Server) {
+			failover(user)
+		}
 
 		id := uuid.New().String()
+		session := getSession(user)
+
+		// NB! Capture the pod, the user might be moved to another one while the job is processed
+		server := user.Server
 
-		job := Job{
+		job := &Job{
 			ID:      id,
 			Prompt:  prompt,
 			Session: user.SessionID,
+			History: session.replay(server),
 		}
 
-		// -- create JSON request body
-		body, err := json.Marshal(job)
-		if err != nil {
-			user.Status = ""
-			log.Errorw("[ ERR ] Problem marshalling request", "id", id, "prompt", prompt)
-			return c.Send("Проблема с обработкой запроса, попробуйте убрать спецсимволы...")
-		}
-		//prompt = strings.Trim(string(safePrompt), `\"`)
+		// -- allow user to abort the job with /stop command or inline button
 
-		//body := fmt.Sprintf(`{"id":"%s","session":"%s","prompt":"%s"}`, id, user.SessionID, prompt)
-		//bodyReader := bytes.NewReader([]byte(body))
-		bodyReader := bytes.NewReader(body)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
 
-		// -- create HTTP request
-		url := user.Server + "/jobs"
-		req, err := http.NewRequest(http.MethodPost, url, bodyReader)
-		if err != nil {
-			user.Status = ""
-			log.Errorw("[ ERR ] Could not create HTTP request", "id", id, "error", err.Error())
-			return c.Send("Не могу работать с этим запросом :(")
-		}
-		req.Header.Set("Content-Type", "application/json")
+		mu.Lock()
+		user.job = job
+		user.stop = cancel
+		mu.Unlock()
 
-		// -- send request to GPU pod
-		res, err := slowHTTP.Do(req)
-		if err != nil {
-			user.Status = ""
-			log.Errorw("[ ERR ] Problem with HTTP request", "id", id, "error", err.Error())
-			return c.Send("Проблемы со связью, попробуйте еще раз...")
-		}
-		defer res.Body.Close()
+		defer func() {
+			mu.Lock()
+			if user.job == job {
+				user.job = nil
+				user.stop = nil
+			}
+			user.land(id)
+			mu.Unlock()
+		}()
 
-		fmt.Printf("\n[ NET ] GPU POST Req was sent") // DEBUG
+		stopMarkup := &tele.ReplyMarkup{}
+		stopMarkup.Inline(stopMarkup.Row(stopMarkup.Data("⏹ Стоп", "stop", id)))
 
-		if res.StatusCode != 200 {
-			fmt.Printf("\n[ ERR ] Wrong status code = %d", res.StatusCode) // DEBUG
-			log.Errorw("[ ERR ] Wrong status code while sending new job", "id", id, "code", res.StatusCode)
-			fmt.Printf("[ ERR ] Wrong status code while sending new job : %d", res.StatusCode) // DEBUG
+		// -- send request to GPU pod, retrying on other healthy pods of the mode if it fails
 
-			// Requested ID was not found!
-			// FIXME: Think again about right logic here
-			//if res.StatusCode == 404 {
-			//	user.Status = ""
-			//	user.SessionID = "" // NB! Session will be created with a new request
-			//	return c.Send("Неожиданная ошибка, попробуйте еще раз...")
-			//}
+		var backend Backend
+		var tried []string
+		var err error
+		for {
+			backend = newBackend(server)
+			tried = append(tried, server)
+
+			err = ErrBreakerOpen
+			if breaker.allow(server) {
+				podStarted(server)
+				err = backend.Submit(ctx, job)
+				if err == nil {
+					breaker.success(server)
+					break
+				}
+				podFinished(server)
+				if ctx.Err() == nil && !errors.Is(err, ErrBadRequest) {
+					breaker.failure(server, err)
+				} else {
+					breaker.release(server)
+				}
+			}
 
-			//time.Sleep(2000 * time.Millisecond) // wait in case of problems
-			//continue
-		}
+			if ctx.Err() != nil || errors.Is(err, ErrBadRequest) || len(tried) >= submitAttempts || !failover(user, tried...) {
+				break
+			}
 
-		// wait for 3 sec to provide GPU with some time to start doing the task
-		time.Sleep(3000 * time.Millisecond)
+			log.Errorw("[ ERR ] Problem sending new job, retry on another pod", "id", id, "server", server, "error", err.Error())
+			server = user.Server
+			session = getSession(user)
+			job.Session = user.SessionID
+			job.History = session.replay(server)
+		}
+		if err == nil {
+			defer podFinished(server)
+			user.takeOff(job, server, answer)
+		}
 
-		url = user.Server + "/jobs/" + id
-		req, err = http.NewRequest(http.MethodGet, url, nil)
-		// There should not be an errors at all, so just log it and return nothing
+		if errors.Is(err, ErrBadRequest) {
+			user.Status = ""
+			log.Errorw("[ ERR ] Could not create HTTP request", "id", id, "error", err.Error())
+			return answer.Say("Не могу работать с этим запросом :(")
+		}
+		if ctx.Err() != nil {
+			return stopped(c, user, backend, job, answer)
+		}
 		if err != nil {
 			user.Status = ""
-			log.Errorw("[ ERR ] Unexpected problem while creating HTTP request", "id", id, "error", err.Error())
-			//return c.Send("Неожиданная проблема на сервере :(")
-			return nil
+			log.Errorw("[ ERR ] Problem with HTTP request", "id", id, "error", err.Error())
+			return answer.Say("Проблемы со связью, попробуйте еще раз...")
 		}
-		req.Header.Set("Content-Type", "application/json")
 
-		//var job Job
+		// -- wait for the output and stream it into TG message
+
 		var errorAttempts int
-		var msg *tele.Message
-		for {
+		answer.markup = stopMarkup
+		filters := filtersFor(user.Mode, server)
+		err = backend.Stream(ctx, job, func(output string) error {
+
+			output = filters.apply(output, false)
+			fmt.Printf("\n\nOUTPUT = %s", output) // DEBUG
 
-			//fmt.Printf("\nfastHTTP.Do...")
-			// FIXME: Better and robust handling with error checking and deadlines
-			res, err := fastHTTP.Do(req)
+			// create the message if needed, or edit existing with the new content
+			// NB! Edits are queued and coalesced by the sender, so TG limits are never exceeded
+			err := answer.Update(output)
 			if err != nil {
-				fmt.Printf("\nERROR = %s", err.Error()) // DEBUG
-				log.Errorw("[ ERR ] Problem with HTTP request", "id", id, "error", err.Error())
-				//return c.Send("Проблемы со связью, попробуйте еще раз...")
+				fmt.Printf("\nmsg edit ERROR = %s", err.Error())
+				log.Errorw("[ ERR ] Problem sending message", "id", id, "error", err.Error())
 				errorAttempts++
 				if errorAttempts > 10 {
-					user.Status = ""
-					return c.Send("Проблемы со связью, попробуйте еще раз...")
-				}
-				time.Sleep(3000 * time.Millisecond) // wait in case of problems
-				continue
-			}
-
-			fmt.Printf("\n[ NET ] GPU GET Req was sent") // DEBUG
-
-			if res.StatusCode != 200 {
-				fmt.Printf("\n[ ERR ] Wrong status code = %d", res.StatusCode) // DEBUG
-				log.Errorw("[ ERR ] Wrong status code", "id", id, "code", res.StatusCode)
-
-				// Requested ID was not found!
-				// FIXME: Think again about right logic here
-				if res.StatusCode == 404 {
-					user.Status = ""
-					user.SessionID = "" // NB! Session will be created with a new request
-					return c.Send("Неожиданная ошибка, попробуйте еще раз...")
+					return fmt.Errorf("%w: %s", errTelegram, err.Error())
 				}
-
 				time.Sleep(3000 * time.Millisecond) // wait in case of problems
-				continue
+			} else {
+				user.progress(id, answer, output)
 			}
 
-			//fmt.Printf("\njson.Unmarshal...")
-			body, err := io.ReadAll(res.Body)
-			err = json.Unmarshal(body, &job) // TODO: Error Handling
-			if err != nil {
-				fmt.Printf("\nERROR = %s", err.Error())
-				fmt.Printf("\nBODY = %s", body) // DEBUG
-				log.Errorw("[ ERR ] Problem unmarshalling JSON response", "id", id, "error", err.Error(), "body", body)
-				//return c.Send("Проблемы со связью, попробуйте еще раз...")
-				errorAttempts++
-				if errorAttempts > 8 {
-					user.Status = ""
-					return c.Send("Проблемы со связью, попробуйте еще раз...")
-				}
-				time.Sleep(3000 * time.Millisecond) // wait in case of problems
-				continue
-			}
+			return nil
+		})
 
-			// do some replacing to allow correct Telegram Markdown
-			// output := job.Output
-			//output = strings.ReplaceAll(output, "\n* ", "\n- ") // TODO: bullet? middle point?
-			//output = strings.ReplaceAll(output, "**", "*")
-			//output = strings.ReplaceAll(output, "__", "_")
-
-			output := ""
-			prev := ""
-			for _, rune := range job.Output + " " {
-				switch {
-				case prev == "**" && rune != '*':
-					output += "*"
-					prev = ""
-				case prev == "*" && rune != '*':
-					output += string("\\*")
-					prev = ""
-				case rune == '*':
-					prev += "*"
-					continue
-				case rune != '*' && len(prev) > 0:
-					output += strings.ReplaceAll(prev, "*", "\\*")
-					prev = ""
-				case rune == '[':
-					output += string("\\[")
-					continue
-					//case rune == ']':
-					//	output += string("\\]")
-					//	continue
-				}
-				output += string(rune)
-			}
-			output = strings.Trim(output, " ")
-			fmt.Printf("\n\nOUTPUT = %s", output) // DEBUG
-			/*
-				// output = "Hello!" // DEBUG
-				eosFound := false
-				if strings.Contains(output, "<|im_end|>") || strings.Contains(output, "<|eot_id|>") {
-					fmt.Printf("\n[ <|END|> ]") // DEBUG
-					eosFound = true
-
-					pos := strings.Index(output, "<|eot_id|>")
-					fmt.Printf("\n\npos = %v", pos)
-					//utf8 := []rune(output)
-					//fmt.Printf("\n\nutf8 = %v", utf8)
-					output = string(output[:pos])
-					fmt.Printf("\n\noutput = %v", output)
-
-					//output = strings.ReplaceAll(output, "<|im_end|>", "") // FIXME: Nous 8B
-					//output = strings.ReplaceAll(output, "<|eot_id|>", "") // FIXME: Nous 8B
-					//output, eosFound = strings.CutSuffix(output, "<|eot_id|>") // FIXME: Nous 8B
-					//eosFlag = true
-				}
-			*/
-			/*
-				output, found := strings.CutSuffix(output, "<|im_end|>") // FIXME: Nous 8B
-				if found {
-					break
-				}
-				output, found = strings.CutSuffix(output, "<|eot_id|>") // FIXME: Nous 8B
-				if found {
-					break
-				}*/
-			///// fmt.Printf("\n\nOUTPUT = %s | %v", output, eosFound) // DEBUG
+		job.Output = filters.apply(job.Output, true)
 
-			// create the message if needed, or edit existing with the new content
-			if msg == nil && output != "" {
-				fmt.Printf("\n\nNEW MSG will send = %s", output) // DEBUG
-				msg, err = bot.Send(tgUser, output)
-				fmt.Printf("\n\nSEND OK for tgUser %+v", tgUser) // DEBUG
-				if err != nil {
-					fmt.Printf("\n[ ERR ] nil message ERROR = %s", err.Error())
-					log.Errorw("[ ERR ] Problem sending message", "id", id, "error", err.Error())
-					//return c.Send("Проблемы со связью, попробуйте еще раз...")
-					errorAttempts++
-					if errorAttempts > 10 {
-						user.Status = ""
-						return c.Send("Проблемы со связью, попробуйте еще раз...")
-					}
-					time.Sleep(3000 * time.Millisecond) // wait in case of problems
-					//continue
-					//if foundFlag { // DEBUG
-					//	break
-					//}
-				}
-				//fmt.Printf("\nnil message...")
-			} else if msg != nil {
-				// FIXME: Do not edit too often?
-				// ERROR = telegram: retry after 122 (429)
-				fmt.Printf("\nbot.Edit...")
-				_, err := bot.Edit(msg, output)
-				if err != nil {
-					fmt.Printf("\nmsg edit ERROR = %s", err.Error())
-					log.Errorw("[ ERR ] Problem editing message", "id", id, "error", err.Error())
-					//return c.Send("Проблемы со связью, попробуйте еще раз...")
-					errorAttempts++
-					if errorAttempts > 10 {
-						user.Status = ""
-						return c.Send("Проблемы со связью, попробуйте еще раз...")
-					}
-					time.Sleep(3000 * time.Millisecond) // wait for 1 sec in case of problems
-					//continue
-				}
-				//if msg2 != msg {
-				//	fmt.Printf("\nERROR msg1 != msg2 [ %+v ] [ %+v ]", msg, msg2)
-				//}
-				/*
-					if eosFound { // DEBUG
-						break
-					}*/
+		// -- drop the Stop button, keeping all the output produced so far
+		if answer.Sent() {
+			if err := answer.Finish(job.Output); err != nil {
+				log.Errorw("[ ERR ] Problem editing message", "id", id, "error", err.Error())
 			}
+		}
 
-			// FIXME: We need MORE conditions to leave the loop
-			if job.Status == "finished" {
-				fmt.Printf("\njob.Status == finished...")
-				break
+		if ctx.Err() != nil {
+			session.record(prompt, job.Output, server)
+			user.answered(job.Output)
+			return stopped(c, user, backend, job, answer)
+		}
+		// NB! The job lost by the pod is not the pod failure, as the pod answers right
+		if err != nil && !errors.Is(err, errTelegram) && !errors.Is(err, ErrBadRequest) && !errors.Is(err, ErrJobNotFound) {
+			breaker.failure(server, err)
+		}
+		if errors.Is(err, ErrJobNotFound) {
+			user.Status = ""
+			user.SessionID = "" // NB! Session will be created with a new request
+			return answer.Say("Неожиданная ошибка, попробуйте еще раз...")
+		}
+		if errors.Is(err, ErrBadRequest) {
+			// There should not be an errors at all, so just log it and drop the placeholder if nothing was shown
+			user.Status = ""
+			log.Errorw("[ ERR ] Unexpected problem while creating HTTP request", "id", id, "error", err.Error())
+			if !answer.Sent() {
+				return answer.Say("Неожиданная ошибка, попробуйте еще раз...")
 			}
+			return nil
+		}
+		if err != nil {
+			user.Status = ""
+			return answer.Say("Проблемы со связью, попробуйте еще раз...")
+		}
 
-			// FIXME: Do not edit too often?
-			// ERROR = telegram: retry after 122 (429)
-			// TODO: Correct sleep time depending on how often we request message editing to conform TG limits
-			//fmt.Printf("\nSleep...")
-			fmt.Printf(" [ WAIT-WHILE-REQ-PROCESSED ] ") // DEBUG
-			time.Sleep(3000 * time.Millisecond)
+		if !answer.Sent() {
+			answer.Say("Пустой ответ, попробуйте еще раз...")
 		}
 
+		session.record(prompt, job.Output, server)
+		user.answered(job.Output)
+
 		// TODO: Log finished message with time elapsed
-		//return c.Send(string(job.Output))
-		//fmt.Printf("\n\nFINISHED")
 
 		fmt.Printf("\nFinished...")
 		log.Infow("[ MSG ] Message finished", "id", id)
@@ -636,6 +618,24 @@ func main() {
 		return new(ctx)
 	})
 
+	// -- Show the history of current session
+
+	bot.Handle("/history", func(ctx tele.Context) error {
+		return showHistory(ctx)
+	})
+
+	// -- Abort the job in flight
+
+	bot.Handle("/stop", func(ctx tele.Context) error {
+		return stop(ctx)
+	})
+	bot.Handle(&tele.Btn{Unique: "stop"}, func(ctx tele.Context) error {
+		if !cancelJob(ctx.Sender().ID, ctx.Data()) {
+			return ctx.Respond(&tele.CallbackResponse{Text: "Ответ уже готов"})
+		}
+		return ctx.Respond(&tele.CallbackResponse{Text: "Останавливаю..."})
+	})
+
 	// -- Switch into the PRO mode
 
 	bot.Handle("/pro", func(ctx tele.Context) error {
@@ -648,6 +648,14 @@ func main() {
 		return chat(ctx)
 	})
 
+	// -- All messages go to TG through the single queue
+
+	sender = newSender(bot)
+
+	// -- Finish jobs which were in flight when the bot was stopped
+
+	resumeFlights()
+
 	fmt.Printf("\n[ START ] Starting interchange with Telegram...")
 	log.Info("[ START ] Start TG interchange...")
 	bot.Start()
@@ -658,20 +666,19 @@ func main() {
 func start(c tele.Context) error {
 	tgUser := c.Sender()
 
-	mu.Lock()
-	user, found := users[tgUser.ID]
-	mu.Unlock()
+	user, found := users.Get(tgUser.ID)
 
 	if !found {
 		return nil // FIXME: Is it possible?
 	}
 
 	user.Mode = "chat"
-	user.Server = randomPod(user.Mode)
+	user.Server = pickPod(user.Mode)
 	user.SessionID = uuid.New().String()
+	users.Put(user)
 
 	log.Infow("[ USER ] Start with /start command", "user", tgUser.ID)
-	return c.Send(helloMessage)
+	return reply(c, helloMessage)
 }
 
 // -- new
@@ -679,19 +686,62 @@ func start(c tele.Context) error {
 func new(c tele.Context) error {
 	tgUser := c.Sender()
 
-	mu.Lock()
-	user, found := users[tgUser.ID]
-	mu.Unlock()
+	user, found := users.Get(tgUser.ID)
 
 	if !found {
 		return nil // FIXME: Is it possible?
 	}
 
-	user.Server = randomPod(user.Mode)
+	user.Server = pickPod(user.Mode)
 	user.SessionID = uuid.New().String()
+	users.Put(user)
 
 	log.Infow("[ USER ] New session", "user", tgUser.ID)
-	return c.Send("Начинаю новую сессию...")
+	return reply(c, "Начинаю новую сессию...")
+}
+
+// -- stop
+
+func stop(c tele.Context) error {
+	if !cancelJob(c.Sender().ID, "") {
+		return reply(c, "Сейчас нечего останавливать...")
+	}
+	return nil
+}
+
+// -- history
+
+func showHistory(c tele.Context) error {
+	tgUser := c.Sender()
+
+	user, found := users.Get(tgUser.ID)
+
+	if !found {
+		return nil // FIXME: Is it possible?
+	}
+
+	messages := history(user.SessionID)
+	if len(messages) == 0 {
+		return reply(c, "В этом диалоге пока пусто...")
+	}
+
+	// NB! Only the last turns are shown to fit within TG message limits
+	if len(messages) > historyShown {
+		messages = messages[len(messages)-historyShown:]
+	}
+
+	text := ""
+	for _, message := range messages {
+		icon := "🤖"
+		if message.Role == "user" {
+			icon = "👤"
+		}
+		text += icon + " " + formatHTML(shorten(message.Content, 200)) + "\n\n"
+	}
+
+	log.Infow("[ USER ] Show history", "user", tgUser.ID, "session", user.SessionID)
+	text, opts := formatted(text)
+	return reply(c, text, opts...)
 }
 
 // -- pro
@@ -699,20 +749,19 @@ func new(c tele.Context) error {
 func pro(c tele.Context) error {
 	tgUser := c.Sender()
 
-	mu.Lock()
-	user, found := users[tgUser.ID]
-	mu.Unlock()
+	user, found := users.Get(tgUser.ID)
 
 	if !found {
 		return nil // FIXME: Is it possible?
 	}
 
 	user.Mode = "pro"
-	user.Server = randomPod(user.Mode)
+	user.Server = pickPod(user.Mode)
 	user.SessionID = uuid.New().String()
+	users.Put(user)
 
 	log.Infow("[ USER ] Switched to PRO plan", "user", tgUser.ID)
-	return c.Send("Включаю полную мощность...")
+	return reply(c, "Включаю полную мощность...")
 }
 
 // -- chat
@@ -720,31 +769,81 @@ func pro(c tele.Context) error {
 func chat(c tele.Context) error {
 	tgUser := c.Sender()
 
-	mu.Lock()
-	user, found := users[tgUser.ID]
-	mu.Unlock()
+	user, found := users.Get(tgUser.ID)
 
 	if !found {
 		return nil // FIXME: Is it possible?
 	}
 
 	user.Mode = "chat"
-	user.Server = randomPod(user.Mode)
+	user.Server = pickPod(user.Mode)
 	user.SessionID = uuid.New().String()
+	users.Put(user)
 
 	log.Infow("[ USER ] Switched to CHAT mode", "user", tgUser.ID)
-	return c.Send("Переключаюсь в режим чата...")
+	return reply(c, "Переключаюсь в режим чата...")
 }
 
 // -- Helpers
 
-func randomPod(mode string) string {
-	max := len(zoo[mode])
-	pod := rand.Intn(max)
-	for pod == max {
-		pod = rand.Intn(max)
+// reply sends the message to the chat of the update through the sender queue
+func reply(c tele.Context, what any, opts ...any) error {
+	_, err := sender.Send(c.Recipient(), what, opts...)
+	return err
+}
+
+// shorten cuts the text to the given number of runes
+func shorten(text string, max int) string {
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+	return string(runes[:max]) + "..."
+}
+
+// cancelJob aborts the job in flight of the user [ with given ID, if not empty ]
+func cancelJob(tgid int64, id string) bool {
+	user, found := users.Get(tgid)
+
+	mu.Lock()
+	var cancel context.CancelFunc
+	if found && user.job != nil && (id == "" || user.job.ID == id) {
+		cancel = user.stop
+		id = user.job.ID
+	}
+	mu.Unlock()
+
+	if cancel == nil {
+		return false
+	}
+
+	log.Infow("[ USER ] Stop the job", "user", tgid, "id", id)
+	cancel()
+	return true
+}
+
+// stopped releases the user slot right away after the job was aborted,
+// and asks the pod to stop wasting GPU in background
+func stopped(c tele.Context, user *User, backend Backend, job *Job, answer *Answer) error {
+	mu.Lock()
+	user.Status = ""
+	mu.Unlock()
+
+	fmt.Printf("\nStopped...")
+	log.Infow("[ MSG ] Message was stopped", "id", job.ID)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := backend.Cancel(ctx, job); err != nil {
+			log.Errorw("[ ERR ] Problem cancelling the job", "id", job.ID, "error", err.Error())
+		}
+	}()
+
+	if !answer.Sent() {
+		return answer.Say("Остановлено.")
 	}
-	return zoo[mode][pod]
+	return nil
 }
 
 func isPodActive(mode, pod string) bool {